@@ -0,0 +1,56 @@
+package sup
+
+import (
+	"io"
+	"sync"
+)
+
+// hostOutput buffers the output of a task on a client, STDOUT and STDERR
+// in the order written, see Stackup.BufferOutput.
+type hostOutput struct {
+	chunks []outputChunk
+	mu     sync.Mutex
+}
+
+// outputChunk is a write of the client's STDOUT or STDERR.
+type outputChunk struct {
+	stderr bool
+	data   []byte
+}
+
+// writer returns writer of the client's STDOUT, or STDERR, to the buffer.
+func (out *hostOutput) writer(stderr bool) io.Writer {
+	return &hostOutputWriter{out: out, stderr: stderr}
+}
+
+// flush writes the buffered output to stdout and stderr, as a block
+// serialized by mu with the other clients' blocks.
+func (out *hostOutput) flush(stdout, stderr io.Writer, mu *sync.Mutex) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if len(out.chunks) == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, chunk := range out.chunks {
+		if chunk.stderr {
+			stderr.Write(chunk.data)
+		} else {
+			stdout.Write(chunk.data)
+		}
+	}
+	out.chunks = nil
+}
+
+type hostOutputWriter struct {
+	out    *hostOutput
+	stderr bool
+}
+
+func (w *hostOutputWriter) Write(p []byte) (int, error) {
+	w.out.mu.Lock()
+	defer w.out.mu.Unlock()
+	w.out.chunks = append(w.out.chunks, outputChunk{w.stderr, append([]byte{}, p...)})
+	return len(p), nil
+}
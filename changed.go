@@ -0,0 +1,70 @@
+package sup
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// changeCheck records STDOUT of the command's changed check on each client,
+// run before and after the command. The client is changed by the command
+// if the outputs differ.
+type changeCheck struct {
+	before map[Client]string
+	after  map[Client]string
+	mu     sync.Mutex
+}
+
+func newChangeCheck() *changeCheck {
+	return &changeCheck{
+		before: make(map[Client]string),
+		after:  make(map[Client]string),
+	}
+}
+
+// task returns the task running the check, before or after the command.
+// Its STDOUT is recorded instead of printed.
+func (check *changeCheck) task(run string, after bool) Task {
+	outputs := check.before
+	if after {
+		outputs = check.after
+	}
+	return Task{
+		Run: run,
+		Output: func(c Client) (io.WriteCloser, error) {
+			return &checkOutput{check: check, outputs: outputs, c: c}, nil
+		},
+		check: check,
+	}
+}
+
+// changed reports whether the client was changed by the command, or !ok
+// if the check didn't run on the client both before and after.
+func (check *changeCheck) changed(c Client) (changed bool, ok bool) {
+	check.mu.Lock()
+	defer check.mu.Unlock()
+	before, ok := check.before[c]
+	if !ok {
+		return false, false
+	}
+	after, ok := check.after[c]
+	if !ok {
+		return false, false
+	}
+	return before != after, true
+}
+
+// checkOutput records the client's check output once closed.
+type checkOutput struct {
+	bytes.Buffer
+	check   *changeCheck
+	outputs map[Client]string
+	c       Client
+}
+
+func (w *checkOutput) Close() error {
+	w.check.mu.Lock()
+	defer w.check.mu.Unlock()
+	w.outputs[w.c] = w.String()
+	return nil
+}
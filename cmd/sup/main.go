@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"regexp"
@@ -18,22 +21,48 @@ import (
 )
 
 var (
-	supfile     string
+	supfiles    flagStringSlice
 	envVars     flagStringSlice
 	sshConfig   string
 	onlyHosts   string
 	exceptHosts string
+	hostsFilter string
+	adHoc       string
+	tags        string
+	refreshInv  bool
+	lint        bool
+	lintStrict  bool
+	listHosts   bool
+	planFormat  string
+	migrateTo   string
+	strictHosts bool
+	strictEnv   bool
 
 	debug         bool
 	disablePrefix bool
+	prefixTmpl    string
+	noColor       bool
+	noSummary     bool
+	dryRun        bool
+	jsonOutput    bool
+	askSudoPass   bool
+	assumeYes     bool
+	preflight     time.Duration
+	heartbeat     time.Duration
+	maxParallel   int
+	uploadLimit   string
+	timestamps    bool
+	logLevel      string
+	hostLogDir    string
+	hostLogName   string
+	hostLogsOnly  bool
+	bufferOutput  bool
+	grepOutput    string
 
 	showVersion bool
 	showHelp    bool
 
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
-	ErrUnknownNetwork   = errors.New("Unknown network")
-	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
-	ErrCmd              = errors.New("Unknown command/target")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK [COMMAND ...]\n       sup [OPTIONS] -c 'COMMAND STRING' NETWORK\n       sup [OPTIONS] --tags TAG[,TAG...] NETWORK\n       sup [OPTIONS] --list NETWORK\n       sup [OPTIONS] --plan json|dot NETWORK [TARGET]\n       sup [OPTIONS] --migrate VERSION\n       sup [ --help | -v | --version ]")
 	ErrTargetNoCommands = errors.New("No commands defined for a given target")
 	ErrConfigFile       = errors.New("Unknown ssh_config file")
 )
@@ -50,16 +79,47 @@ func (f *flagStringSlice) Set(value string) error {
 }
 
 func init() {
-	flag.StringVar(&supfile, "f", "", "Custom path to ./Supfile[.yml]")
+	flag.Var(&supfiles, "f", "Custom path to ./Supfile[.yml], - for STDIN or http(s):// URL; multiple are merged in order")
 	flag.Var(&envVars, "e", "Set environment variables")
 	flag.Var(&envVars, "env", "Set environment variables")
 	flag.StringVar(&sshConfig, "sshconfig", "", "Read SSH Config file, ie. ~/.ssh/config file")
 	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using regexp")
 	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using regexp")
+	flag.StringVar(&hostsFilter, "hosts", "", "Filter hosts using comma-separated glob patterns")
+	flag.BoolVar(&refreshInv, "refresh-inventory", false, "Re-run inventory commands, ignoring their caches")
+	flag.BoolVar(&strictHosts, "strict-hosts", false, "Fail on hosts looking like undefined host aliases")
+	flag.BoolVar(&strictEnv, "strict-env", false, "Fail on commands referencing undefined env vars, see strict_env")
+	flag.BoolVar(&lint, "lint", false, "Warn about commands not referenced by any target")
+	flag.BoolVar(&lintStrict, "lint-strict", false, "Fail on commands not referenced by any target")
+	flag.BoolVar(&listHosts, "list", false, "Print hosts of the network, after inventories and filters, instead of running commands")
+	flag.StringVar(&migrateTo, "migrate", "", "Print the Supfile migrated to the version of the format, ie. \"0.5\", instead of running commands")
+	flag.StringVar(&planFormat, "plan", "", "Print the execution plan of the target on the network as \"json\" or \"dot\" graph instead of running commands")
+	flag.StringVar(&adHoc, "c", "", "Run ad-hoc command string instead of Supfile commands")
+	flag.StringVar(&adHoc, "command", "", "Run ad-hoc command string instead of Supfile commands")
+	flag.StringVar(&tags, "tags", "", "Run commands tagged by any of the comma-separated tags instead of named commands")
 
 	flag.BoolVar(&debug, "D", false, "Enable debug mode")
 	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
 	flag.BoolVar(&disablePrefix, "disable-prefix", false, "Disable hostname prefix")
+	flag.StringVar(&prefixTmpl, "prefix-template", "", "Hostname prefix template, ie. '[{{.Host}}] '")
+	flag.BoolVar(&noColor, "no-color", false, "Disable colors, default if STDOUT isn't a terminal")
+	flag.BoolVar(&noSummary, "no-summary", false, "Don't print summary of the commands' results")
+	flag.BoolVar(&timestamps, "timestamps", false, "Prefix messages and output lines by time and level")
+	flag.StringVar(&logLevel, "log-level", "info", "Least severe level of messages printed: info, warn or error")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print commands and hosts without running them")
+	flag.BoolVar(&jsonOutput, "json", false, "Print results as newline-delimited JSON")
+	flag.StringVar(&hostLogDir, "host-logs", "", "Write output of each host to a file in the directory, ie. logs")
+	flag.StringVar(&hostLogName, "host-log-name", sup.DefaultHostLogName, "File name template of the host logs")
+	flag.BoolVar(&hostLogsOnly, "host-logs-only", false, "Write output to the host logs only, instead of streaming it")
+	flag.BoolVar(&bufferOutput, "buffer-output", false, "Print each host's output as a block once it finishes, instead of streaming it")
+	flag.StringVar(&grepOutput, "grep", "", "Print only the output lines matching the regexp")
+	flag.BoolVar(&askSudoPass, "ask-sudo-pass", false, "Ask for sudo password of commands run as another user")
+	flag.BoolVar(&assumeYes, "y", false, "Run on networks requiring confirmation without asking")
+	flag.BoolVar(&assumeYes, "yes", false, "Run on networks requiring confirmation without asking")
+	flag.DurationVar(&preflight, "preflight", 0, "Check hosts are reachable within the timeout before running, ie. 5s")
+	flag.DurationVar(&heartbeat, "heartbeat", 0, "Print hosts still running a command every interval, ie. 30s, if STDOUT is a terminal")
+	flag.IntVar(&maxParallel, "max-parallel", 0, "Max number of hosts running a command at once, regardless of serial")
+	flag.StringVar(&uploadLimit, "upload-limit", "", "Max bandwidth of uploads in total, in bytes per second, ie. 10M")
 
 	flag.BoolVar(&showVersion, "v", false, "Print version")
 	flag.BoolVar(&showVersion, "version", false, "Print version")
@@ -80,6 +140,9 @@ func networkUsage(conf *sup.Supfile) {
 		for _, host := range network.Hosts {
 			fmt.Fprintf(w, "\t- %v\n", host)
 		}
+		for _, group := range network.GroupNames() {
+			fmt.Fprintf(w, "\t- %v:%v: %v\n", name, group, strings.Join(network.Groups[group], ", "))
+		}
 	}
 	fmt.Fprintln(w)
 }
@@ -104,169 +167,156 @@ func cmdUsage(conf *sup.Supfile) {
 	fmt.Fprintln(w)
 }
 
-// parseArgs parses args and returns network and commands to be run.
+// parseArgs parses args and returns networks and commands to be run.
 // On error, it prints usage and exits.
-func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
-	var commands []*sup.Command
-
+func parseArgs(conf *sup.Supfile) ([]*sup.Network, []*sup.Command, error) {
 	args := flag.Args()
 	if len(args) < 1 {
 		networkUsage(conf)
 		return nil, nil, ErrUsage
 	}
 
-	// Does the <network> exist?
-	network, ok := conf.Networks.Get(args[0])
-	if !ok {
+	// Does the <network>, or any network matching the pattern, exist
+	// and have at least one host?
+	networks, err := conf.ResolveNetworks(args[0], cliEnvVars())
+	if err == sup.ErrUnknownNetwork || err == sup.ErrNetworkNoHosts {
 		networkUsage(conf)
-		return nil, nil, ErrUnknownNetwork
+	}
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Parse CLI --env flag env vars, override values defined in Network env.
-	for _, env := range envVars {
-		if len(env) == 0 {
-			continue
+	// Ad-hoc command instead of Supfile commands?
+	if adHoc != "" {
+		if len(args) > 1 || tags != "" {
+			return nil, nil, ErrUsage
 		}
-		i := strings.Index(env, "=")
-		if i < 0 {
-			if len(env) > 0 {
-				network.Env.Set(env, "")
+		command, err := sup.AdHocCommand(adHoc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return networks, []*sup.Command{command}, nil
+	}
+
+	// Tagged commands instead of named ones?
+	if tags != "" {
+		if len(args) > 1 {
+			return nil, nil, ErrUsage
+		}
+		var names []string
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				names = append(names, tag)
 			}
-			continue
 		}
-		network.Env.Set(env[:i], env[i+1:])
+		commands, err := conf.ResolveTags(names...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return networks, commands, nil
+	}
+
+	// Check for the second argument, or run the default command.
+	names := args[1:]
+	if len(names) == 0 {
+		name, ok := conf.DefaultCommand()
+		if !ok {
+			cmdUsage(conf)
+			return nil, nil, ErrUsage
+		}
+		names = []string{name}
 	}
 
-	hosts, err := network.ParseInventory()
+	commands, err := conf.ResolveCommands(names...)
 	if err != nil {
+		cmdUsage(conf)
 		return nil, nil, err
 	}
-	network.Hosts = append(network.Hosts, hosts...)
 
-	// Does the <network> have at least one host?
-	if len(network.Hosts) == 0 {
+	return networks, commands, nil
+}
+
+// printHosts prints the hosts of the network, or of the networks matching
+// the pattern, given by args, that commands would be run on. Hosts of
+// multiple networks are preceded by their network's name.
+func printHosts(conf *sup.Supfile) error {
+	args := flag.Args()
+	if len(args) < 1 {
 		networkUsage(conf)
-		return nil, nil, ErrNetworkNoHosts
+		return ErrUsage
 	}
-
-	// Check for the second argument
-	if len(args) < 2 {
-		cmdUsage(conf)
-		return nil, nil, ErrUsage
+	if len(args) > 1 || adHoc != "" || tags != "" {
+		return ErrUsage
 	}
-
-	// In case of the network.Env needs an initialization
-	if network.Env == nil {
-		network.Env = make(sup.EnvList, 0)
+	networks, err := conf.ResolveNetworks(args[0], cliEnvVars())
+	if err == sup.ErrUnknownNetwork || err == sup.ErrNetworkNoHosts {
+		networkUsage(conf)
 	}
-
-	// Add default env variable with current network
-	network.Env.Set("SUP_NETWORK", args[0])
-
-	// Add default nonce
-	network.Env.Set("SUP_TIME", time.Now().UTC().Format(time.RFC3339))
-	if os.Getenv("SUP_TIME") != "" {
-		network.Env.Set("SUP_TIME", os.Getenv("SUP_TIME"))
+	if err != nil {
+		return err
 	}
 
-	// Add user
-	if os.Getenv("SUP_USER") != "" {
-		network.Env.Set("SUP_USER", os.Getenv("SUP_USER"))
-	} else {
-		network.Env.Set("SUP_USER", os.Getenv("USER"))
-	}
-
-	for _, cmd := range args[1:] {
-		// Target?
-		target, isTarget := conf.Targets.Get(cmd)
-		if isTarget {
-			// Loop over target's commands.
-			for _, cmd := range target {
-				command, isCommand := conf.Commands.Get(cmd)
-				if !isCommand {
-					cmdUsage(conf)
-					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
-				}
-				command.Name = cmd
-				commands = append(commands, &command)
-			}
-		}
-
-		// Command?
-		command, isCommand := conf.Commands.Get(cmd)
-		if isCommand {
-			command.Name = cmd
-			commands = append(commands, &command)
+	app, err := sup.New(conf)
+	if err != nil {
+		return err
+	}
+	app.OnlyHosts(hostsFilter)
+	for _, network := range networks {
+		if err := filterHosts(network); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrapf(err, "network %v", network.Name))
+			os.Exit(sup.ExitUsage)
 		}
-
-		if !isTarget && !isCommand {
-			cmdUsage(conf)
-			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
+		hosts, err := app.Hosts(network)
+		if err != nil {
+			return err
 		}
-	}
-
-	return &network, commands, nil
-}
-
-func resolvePath(path string) string {
-	if path == "" {
-		return ""
-	}
-	if path[:2] == "~/" {
-		usr, err := user.Current()
-		if err == nil {
-			path = filepath.Join(usr.HomeDir, path[2:])
+		for _, host := range hosts {
+			if len(networks) > 1 {
+				fmt.Printf("%v %v\n", network.Name, host)
+			} else {
+				fmt.Println(host)
+			}
 		}
 	}
-	return path
+	return nil
 }
 
-func main() {
-	flag.Parse()
-
-	if showHelp {
-		fmt.Fprintln(os.Stderr, ErrUsage, "\n\nOptions:")
-		flag.PrintDefaults()
-		return
+// printPlanExport prints the execution plan of the target on the network,
+// given by args, in the --plan format.
+func printPlanExport(conf *sup.Supfile) error {
+	args := flag.Args()
+	if len(args) < 1 {
+		networkUsage(conf)
+		return ErrUsage
 	}
-
-	if showVersion {
-		fmt.Fprintln(os.Stderr, sup.VERSION)
-		return
+	if len(args) > 2 || adHoc != "" || tags != "" {
+		return ErrUsage
 	}
-
-	if supfile == "" {
-		supfile = "./Supfile"
+	var target string
+	if len(args) > 1 {
+		target = args[1]
 	}
-	data, err := ioutil.ReadFile(resolvePath(supfile))
-	if err != nil {
-		firstErr := err
-		data, err = ioutil.ReadFile("./Supfile.yml") // Alternative to ./Supfile.
-		if err != nil {
-			fmt.Fprintln(os.Stderr, firstErr)
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
+	plan, err := conf.Plan(args[0], target)
+	if err == sup.ErrUnknownNetwork || err == sup.ErrNetworkNoHosts {
+		networkUsage(conf)
 	}
-	conf, err := sup.NewSupfile(data)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
-
-	// Parse network and commands to be run from args.
-	network, commands, err := parseArgs(conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if planFormat == "dot" {
+		return plan.WriteDOT(os.Stdout)
 	}
+	return plan.WriteJSON(os.Stdout)
+}
 
+// filterHosts filters hosts of the network by --only and --except flags,
+// and applies --sshconfig.
+func filterHosts(network *sup.Network) error {
 	// --only flag filters hosts
 	if onlyHosts != "" {
 		expr, err := regexp.CompilePOSIX(onlyHosts)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
 
 		var hosts []string
@@ -276,8 +326,7 @@ func main() {
 			}
 		}
 		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts))
-			os.Exit(1)
+			return fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts)
 		}
 		network.Hosts = hosts
 	}
@@ -286,8 +335,7 @@ func main() {
 	if exceptHosts != "" {
 		expr, err := regexp.CompilePOSIX(exceptHosts)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
 
 		var hosts []string
@@ -297,8 +345,7 @@ func main() {
 			}
 		}
 		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts))
-			os.Exit(1)
+			return fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts)
 		}
 		network.Hosts = hosts
 	}
@@ -307,8 +354,7 @@ func main() {
 	if sshConfig != "" {
 		confHosts, err := sshconfig.ParseSSHConfig(resolvePath(sshConfig))
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
 
 		// flatten Host -> *SSHHost, not the prettiest
@@ -325,59 +371,363 @@ func main() {
 			conf, found := confMap[host]
 			if found {
 				network.User = conf.User
-				network.IdentityFile = resolvePath(conf.IdentityFile)
+				if conf.IdentityFile != "" {
+					network.IdentityFile = resolvePath(conf.IdentityFile)
+				}
 				network.Hosts = []string{fmt.Sprintf("%s:%d", conf.HostName, conf.Port)}
 			}
 		}
 	}
+	return nil
+}
 
-	var vars sup.EnvList
-	for _, val := range append(conf.Env, network.Env...) {
-		vars.Set(val.Key, val.Value)
+// errReadSupfile is returned if the Supfile can't be read.
+type errReadSupfile struct {
+	error
+}
+
+func (e errReadSupfile) ExitCode() int {
+	return sup.ExitConfig
+}
+
+// loadSupfiles loads the -f Supfiles, merged in order if multiple,
+// ./Supfile or ./Supfile.yml by default.
+func loadSupfiles() (*sup.Supfile, error) {
+	readable := func(path string) string {
+		if path == "-" || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+			return path
+		}
+		return resolvePath(path)
 	}
-	if err := vars.ResolveValues(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if len(supfiles) > 1 {
+		paths := make([]string, len(supfiles))
+		for i, path := range supfiles {
+			paths[i] = readable(path)
+		}
+		return sup.NewSupfiles(paths...)
+	}
+
+	supfile := "./Supfile"
+	if len(supfiles) == 1 {
+		supfile = supfiles[0]
+	}
+	var data []byte
+	var name string
+	var err error
+	if supfile == "-" || strings.HasPrefix(supfile, "http://") || strings.HasPrefix(supfile, "https://") {
+		// Supfile from STDIN or a URL.
+		data, err = sup.ReadSupfile(supfile)
+		if err != nil {
+			return nil, errReadSupfile{err}
+		}
+		name = supfile
+		if supfile == "-" {
+			name = "stdin"
+		}
+	} else {
+		name = readable(supfile)
+		data, err = ioutil.ReadFile(name)
+		if err != nil {
+			firstErr := err
+			name = "./Supfile.yml"
+			data, err = ioutil.ReadFile(name) // Alternative to ./Supfile.
+			if err != nil {
+				return nil, errReadSupfile{fmt.Errorf("%v\n%v", firstErr, err)}
+			}
+		}
+		name = filepath.Clean(name)
 	}
+	return sup.NewSupfileNamed(data, name)
+}
+
+// migrateSupfile prints the -f Supfile, ./Supfile or ./Supfile.yml by
+// default, migrated to the --migrate version.
+func migrateSupfile() error {
+	if len(supfiles) > 1 || len(flag.Args()) > 0 {
+		return ErrUsage
+	}
+	supfile := "./Supfile"
+	if len(supfiles) == 1 {
+		supfile = resolvePath(supfiles[0])
+	} else if _, err := os.Stat(supfile); os.IsNotExist(err) {
+		supfile = "./Supfile.yml" // Alternative to ./Supfile.
+	}
+	data, err := sup.Migrate(supfile, migrateTo)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
 
-	// Parse CLI --env flag env vars, define $SUP_ENV and override values defined in Supfile.
-	var cliVars sup.EnvList
+// cliEnvVars parses CLI --env flag env vars.
+func cliEnvVars() sup.EnvList {
+	var vars sup.EnvList
 	for _, env := range envVars {
 		if len(env) == 0 {
 			continue
 		}
 		i := strings.Index(env, "=")
 		if i < 0 {
-			if len(env) > 0 {
-				vars.Set(env, "")
-			}
+			vars.Set(env, "")
 			continue
 		}
 		vars.Set(env[:i], env[i+1:])
-		cliVars.Set(env[:i], env[i+1:])
+	}
+	return vars
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readPassword reads a line from the terminal with echo disabled.
+// The terminal is used directly, so STDIN stays available to the commands.
+func readPassword(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "opening terminal failed")
+	}
+	defer tty.Close()
+
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	fmt.Fprint(tty, prompt)
+	if err := stty("-echo"); err != nil {
+		return "", errors.Wrap(err, "disabling terminal echo failed")
+	}
+	defer func() {
+		stty("echo")
+		fmt.Fprintln(tty)
+	}()
+
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "reading password failed")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readLine reads a line from the terminal, ie. the operator's confirmation.
+// Without a terminal, ie. in CI, it fails.
+func readLine(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("there's no terminal to ask on, pass --yes to confirm")
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "reading confirmation failed")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func resolvePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if strings.HasPrefix(path, "~/") {
+		usr, err := user.Current()
+		if err == nil {
+			path = filepath.Join(usr.HomeDir, path[2:])
+		}
+	}
+	return path
+}
+
+func main() {
+	flag.Parse()
+
+	if showHelp {
+		fmt.Fprintln(os.Stderr, ErrUsage, "\n\nOptions:")
+		flag.PrintDefaults()
+		return
+	}
+
+	if showVersion {
+		fmt.Fprintln(os.Stderr, sup.VERSION)
+		return
+	}
+
+	level, err := sup.ParseLevel(logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(sup.ExitUsage)
+	}
+	sup.DefaultLogger.Timestamps(timestamps)
+	sup.DefaultLogger.Verbosity(level)
+
+	// Migrate the Supfile instead of loading it?
+	if migrateTo != "" {
+		if err := migrateSupfile(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if err == ErrUsage {
+				os.Exit(sup.ExitUsage)
+			}
+			os.Exit(sup.ExitCode(err))
+		}
+		return
+	}
+
+	conf, err := loadSupfiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(sup.ExitCode(err))
+	}
+	conf.RefreshInventory = refreshInv
+	conf.StrictHosts = strictHosts
+	conf.StrictEnv = conf.StrictEnv || strictEnv
+
+	// Lint the Supfile; without a network, that's all.
+	if lint || lintStrict {
+		if err := conf.Lint(lintStrict); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(sup.ExitCode(err))
+		}
+		if len(flag.Args()) == 0 {
+			return
+		}
+	}
+
+	// List the hosts instead of running commands?
+	if listHosts {
+		if err := printHosts(conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if err == ErrUsage {
+				os.Exit(sup.ExitUsage)
+			}
+			os.Exit(sup.ExitCode(err))
+		}
+		return
+	}
+
+	// Export the plan instead of running commands?
+	if planFormat != "" {
+		if planFormat != "json" && planFormat != "dot" {
+			fmt.Fprintf(os.Stderr, "invalid --plan %q: expected json or dot\n", planFormat)
+			os.Exit(sup.ExitUsage)
+		}
+		if err := printPlanExport(conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if err == ErrUsage {
+				os.Exit(sup.ExitUsage)
+			}
+			os.Exit(sup.ExitCode(err))
+		}
+		return
+	}
+
+	// Parse network and commands to be run from args.
+	networks, commands, err := parseArgs(conf)
+	if err == ErrUsage {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(sup.ExitUsage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(sup.ExitCode(err))
 	}
 
-	// SUP_ENV is generated only from CLI env vars.
-	// Separate loop to omit duplicates.
-	supEnv := ""
-	for _, v := range cliVars {
-		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
+	// Filter hosts of the networks; networks left without hosts are skipped.
+	var filtered []*sup.Network
+	var filterErr error
+	for _, network := range networks {
+		if err := filterHosts(network); err != nil {
+			filterErr = err
+			continue
+		}
+		filtered = append(filtered, network)
 	}
-	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
+	if len(filtered) == 0 {
+		fmt.Fprintln(os.Stderr, filterErr)
+		os.Exit(sup.ExitUsage)
+	}
+	networks = filtered
 
 	// Create new Stackup app.
 	app, err := sup.New(conf)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(sup.ExitCode(err))
 	}
 	app.Debug(debug)
 	app.Prefix(!disablePrefix)
+	if prefixTmpl != "" {
+		if err := app.PrefixTemplate(prefixTmpl); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(sup.ExitUsage)
+		}
+	}
+	app.Color(!noColor && isTerminal(os.Stdout))
+	app.Summary(!noSummary)
+	app.Timestamps(timestamps)
+	app.Verbosity(level)
+	app.DryRun(dryRun)
+	app.BufferOutput(bufferOutput)
+	if grepOutput != "" {
+		expr, err := regexp.Compile(grepOutput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --grep regexp: %v\n", err)
+			os.Exit(sup.ExitUsage)
+		}
+		app.Grep(expr)
+	}
+	app.Preflight(preflight)
+	if isTerminal(os.Stdout) {
+		app.Heartbeat(heartbeat)
+	}
+	if maxParallel < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --max-parallel %v: must not be negative\n", maxParallel)
+		os.Exit(sup.ExitUsage)
+	}
+	app.MaxParallel(maxParallel)
+	if uploadLimit != "" {
+		rate, err := sup.ParseRate(uploadLimit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(sup.ExitUsage)
+		}
+		app.UploadLimit(rate)
+	}
+	app.OnlyHosts(hostsFilter)
+	app.AssumeYes(assumeYes)
+	app.Prompt(readLine)
+	if jsonOutput {
+		app.JSON(os.Stdout)
+	}
+	if hostLogDir != "" {
+		if err := app.HostLogs(hostLogDir, hostLogName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(sup.ExitUsage)
+		}
+		app.HostLogsOnly(hostLogsOnly)
+	}
+
+	// Sudo password, from $SUP_SUDO_PASSWORD or asked for once.
+	if pass := os.Getenv("SUP_SUDO_PASSWORD"); pass != "" {
+		app.SudoPassword(pass)
+	} else if askSudoPass && !dryRun {
+		pass, err := readPassword("Sudo password: ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		app.SudoPassword(pass)
+	}
 
 	// Run all the commands in the given network.
-	err = app.Run(network, vars, commands...)
+	err = app.RunNetworks(networks, cliEnvVars(), commands...)
+	app.Close()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(sup.ExitCode(err))
 	}
 }
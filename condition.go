@@ -0,0 +1,62 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseCondition splits "when" condition into its operands and operator.
+// Supported conditions are "$A == value", "$A != value" and "$A";
+// the latter has no operator and no right operand. Operands may be blank
+// only if quoted, ie. `$A == ""` compares with the empty string.
+func parseCondition(cond string) (left, op, right string, err error) {
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(cond, op); i != -1 {
+			rawLeft, rawRight := cond[:i], cond[i+len(op):]
+			if strings.TrimSpace(rawLeft) == "" || strings.TrimSpace(rawRight) == "" || strings.Contains(rawRight, "==") || strings.Contains(rawRight, "!=") {
+				return "", "", "", fmt.Errorf("invalid condition %q", cond)
+			}
+			return trimOperand(rawLeft), op, trimOperand(rawRight), nil
+		}
+	}
+
+	if strings.TrimSpace(cond) == "" {
+		return "", "", "", fmt.Errorf("invalid condition %q", cond)
+	}
+	return trimOperand(cond), "", "", nil
+}
+
+// evalCondition evaluates "when" condition against the env vars.
+// Undefined env vars expand to empty strings. A condition without
+// an operator is false if it expands to "", "0" or "false".
+func evalCondition(cond string, env EnvList) (bool, error) {
+	left, op, right, err := parseCondition(cond)
+	if err != nil {
+		return false, err
+	}
+
+	if left, err = expandVars(left, env); err != nil {
+		return false, err
+	}
+	if right, err = expandVars(right, env); err != nil {
+		return false, err
+	}
+
+	switch op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	default:
+		return left != "" && left != "0" && left != "false", nil
+	}
+}
+
+// trimOperand trims spaces and quotes around condition operand.
+func trimOperand(operand string) string {
+	operand = strings.TrimSpace(operand)
+	if len(operand) >= 2 && (operand[0] == '"' || operand[0] == '\'') && operand[len(operand)-1] == operand[0] {
+		operand = operand[1 : len(operand)-1]
+	}
+	return operand
+}
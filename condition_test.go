@@ -0,0 +1,81 @@
+package sup
+
+import "testing"
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		cond            string
+		left, op, right string
+		err             bool
+	}{
+		{cond: "$A", left: "$A"},
+		{cond: " $A ", left: "$A"},
+		{cond: "$A == production", left: "$A", op: "==", right: "production"},
+		{cond: "$A!=production", left: "$A", op: "!=", right: "production"},
+		{cond: `"$A" == "a b"`, left: "$A", op: "==", right: "a b"},
+		{cond: `$A == ''`, left: "$A", op: "==", right: ""},
+		{cond: `$A != ""`, left: "$A", op: "!=", right: ""},
+		{cond: `"$A`, left: `"$A`},
+		{cond: "", err: true},
+		{cond: "  ", err: true},
+		{cond: "$A ==", err: true},
+		{cond: "== a", err: true},
+		{cond: "$A == a == b", err: true},
+		{cond: "$A == a != b", err: true},
+	}
+	for _, test := range tests {
+		left, op, right, err := parseCondition(test.cond)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseCondition(%q): got no error", test.cond)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", test.cond, err)
+			continue
+		}
+		if left != test.left || op != test.op || right != test.right {
+			t.Errorf("parseCondition(%q): got %q %q %q, want %q %q %q", test.cond, left, op, right, test.left, test.op, test.right)
+		}
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	env := EnvList{{"ENV", "production"}, {"EMPTY", ""}, {"ZERO", "0"}, {"FALSE", "false"}, {"ONE", "1"}}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"$ENV == production", true},
+		{"${ENV} == production", true},
+		{"$ENV == staging", false},
+		{"$ENV != staging", true},
+		{`"$ENV" == "production"`, true},
+		{"$ENV", true},
+		{"$ONE", true},
+		{"$EMPTY", false},
+		{"$ZERO", false},
+		{"$FALSE", false},
+		{"$UNDEFINED", false},
+		{`$EMPTY == ""`, true},
+		{`$UNDEFINED == ""`, true},
+		{`$ENV == ""`, false},
+		{`$ENV != ''`, true},
+		{"$ENV == $ENV", true},
+	}
+	for _, test := range tests {
+		got, err := evalCondition(test.cond, env)
+		if err != nil {
+			t.Errorf("evalCondition(%q): %v", test.cond, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("evalCondition(%q): got %v, want %v", test.cond, got, test.want)
+		}
+	}
+
+	if _, err := evalCondition("$ENV ==", env); err == nil {
+		t.Errorf("evalCondition(%q): got no error", "$ENV ==")
+	}
+}
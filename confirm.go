@@ -0,0 +1,40 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrNotConfirmed is returned when running on a network requiring
+// confirmation wasn't confirmed, see Network.Confirm.
+type ErrNotConfirmed struct {
+	Network string
+	Reason  string
+}
+
+func (e ErrNotConfirmed) Error() string {
+	return fmt.Sprintf("running on network %v wasn't confirmed: %v", e.Network, e.Reason)
+}
+
+// confirm prints the plan of the commands and asks the operator to type
+// the network's name, if the network requires confirmation, unless
+// confirmations are assumed.
+func (sup *Stackup) confirm(network *Network, envVars EnvList, commands []*Command) error {
+	if !network.Confirm || sup.assumeYes {
+		return nil
+	}
+	if sup.prompt == nil {
+		return ErrNotConfirmed{network.Name, "there's no prompt to ask on"}
+	}
+	if err := sup.printPlan(sup.stderr, network, envVars, commands); err != nil {
+		return err
+	}
+	answer, err := sup.prompt(fmt.Sprintf("Type the network name (%v) to run on it: ", network.Name))
+	if err != nil {
+		return ErrNotConfirmed{network.Name, err.Error()}
+	}
+	if strings.TrimSpace(answer) != network.Name {
+		return ErrNotConfirmed{network.Name, fmt.Sprintf("%q isn't the network name", strings.TrimSpace(answer))}
+	}
+	return nil
+}
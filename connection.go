@@ -0,0 +1,104 @@
+package sup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults of the networks' connect_timeout and keepalive.
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultKeepalive      = 30 * time.Second
+)
+
+// connectTimeout parses the network's connect_timeout, defaultConnectTimeout
+// if empty. Zero means connecting doesn't time out.
+func (n Network) connectTimeout() (time.Duration, error) {
+	return parseNetworkDuration("connect_timeout", n.ConnectTimeout, defaultConnectTimeout)
+}
+
+// keepalive parses the network's keepalive, defaultKeepalive if empty.
+// Zero disables keepalives.
+func (n Network) keepalive() (time.Duration, error) {
+	return parseNetworkDuration("keepalive", n.Keepalive, defaultKeepalive)
+}
+
+func parseNetworkDuration(field, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %v %q", field, value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %v %q: must not be negative", field, value)
+	}
+	return d, nil
+}
+
+// dialTimeout connects to addr by the dialer, failing once connecting,
+// including the SSH handshake, takes longer than the config's timeout,
+// if any. Connections made too late are closed.
+func dialTimeout(dialer SSHDialFunc, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if config.Timeout <= 0 {
+		return dialer("tcp", addr, config)
+	}
+
+	type dialed struct {
+		conn *ssh.Client
+		err  error
+	}
+	ch := make(chan dialed, 1)
+	go func() {
+		conn, err := dialer("tcp", addr, config)
+		ch <- dialed{conn, err}
+	}()
+	select {
+	case d := <-ch:
+		return d.conn, d.err
+	case <-time.After(config.Timeout):
+		go func() {
+			if d := <-ch; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("connecting timed out after %v", config.Timeout)
+	}
+}
+
+// keepAlive sends keepalive requests to the server every interval until
+// done is closed. The connection is closed once a request fails or isn't
+// replied within the interval, so commands fail rather than hang on
+// connections dropped, ie. by firewalls.
+func keepAlive(conn *ssh.Client, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+		case <-time.After(interval):
+		}
+		conn.Close()
+		return
+	}
+}
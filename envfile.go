@@ -0,0 +1,132 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadEnvFiles merges env vars of the Supfile's and networks' env files
+// into their env vars, which take precedence. Relative paths are resolved
+// against dir.
+func (conf *Supfile) loadEnvFiles(dir string) error {
+	env, err := loadEnvFile(conf.EnvFile, conf.EnvFileOptional, dir)
+	if err != nil {
+		return err
+	}
+	conf.Env = mergeEnv(env, conf.Env)
+
+	for _, name := range conf.Networks.Names {
+		network := conf.Networks.nets[name]
+		env, err := loadEnvFile(network.EnvFile, network.EnvFileOptional, dir)
+		if err != nil {
+			return errors.Wrapf(err, "network %v", name)
+		}
+		network.Env = mergeEnv(env, network.Env)
+		conf.Networks.nets[name] = network
+	}
+
+	return nil
+}
+
+// mergeEnv returns env vars of base overridden by those of env.
+func mergeEnv(base, env EnvList) EnvList {
+	if len(base) == 0 {
+		return env
+	}
+	for _, v := range env {
+		base.Set(v.Key, v.Value)
+	}
+	return base
+}
+
+// loadEnvFile reads env vars of the dotenv file, if set. A missing
+// optional file has no env vars.
+func loadEnvFile(path string, optional bool, dir string) (EnvList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file := path
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) && optional {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "env_file")
+	}
+	defer f.Close()
+
+	env, err := parseEnvFile(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "env_file %v", path)
+	}
+	return env, nil
+}
+
+// parseEnvFile parses KEY=value lines, optionally prefixed by "export".
+// Values may be single- or double-quoted, the quotes are stripped. Empty lines
+// and lines starting with # are skipped, so are comments following unquoted
+// values. The values are resolved like those defined in Supfile, see
+// ResolveValues. They aren't part of the errors, as they tend to be secret.
+func parseEnvFile(r io.Reader) (EnvList, error) {
+	var env EnvList
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		i := strings.Index(line, "=")
+		if i < 1 || !isEnvName(strings.TrimSpace(line[:i])) {
+			return nil, fmt.Errorf("line %v: expected KEY=value", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %v: unterminated quoted value of %v", n, key)
+			}
+			value = value[1 : end+1]
+		case strings.HasPrefix(value, `"`):
+			end := -1
+			for j := 1; j < len(value); j++ {
+				if value[j] == '\\' {
+					j++
+				} else if value[j] == '"' {
+					end = j
+					break
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("line %v: unterminated quoted value of %v", n, key)
+			}
+			value = value[1:end]
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+
+		env.Set(key, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
@@ -0,0 +1,51 @@
+package sup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	tests := []struct {
+		in   string
+		want EnvList
+		err  string
+	}{
+		{in: "", want: nil},
+		{in: "# comment\n\n  \n", want: nil},
+		{in: "A=a\nB=b\n", want: EnvList{{"A", "a"}, {"B", "b"}}},
+		{in: "export A=a", want: EnvList{{"A", "a"}}},
+		{in: " A = a ", want: EnvList{{"A", "a"}}},
+		{in: "A=", want: EnvList{{"A", ""}}},
+		{in: "A=a=b", want: EnvList{{"A", "a=b"}}},
+		{in: "A=a\nA=b", want: EnvList{{"A", "b"}}},
+		{in: "A=a # comment", want: EnvList{{"A", "a"}}},
+		{in: "A=a#b", want: EnvList{{"A", "a#b"}}},
+		{in: "A='a # b' # comment", want: EnvList{{"A", "a # b"}}},
+		{in: `A='$B "c"'`, want: EnvList{{"A", `$B "c"`}}},
+		{in: `A="a \"b\" # c" # comment`, want: EnvList{{"A", `a \"b\" # c`}}},
+		{in: "A=a\r\nB=b\r\n", want: EnvList{{"A", "a"}, {"B", "b"}}},
+		{in: "A=a\nno value", err: "line 2: expected KEY=value"},
+		{in: "=a", err: "line 1: expected KEY=value"},
+		{in: "1A=a", err: "line 1: expected KEY=value"},
+		{in: "A='secret", err: "line 1: unterminated quoted value of A"},
+		{in: `A="secret`, err: "line 1: unterminated quoted value of A"},
+	}
+	for _, test := range tests {
+		got, err := parseEnvFile(strings.NewReader(test.in))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseEnvFile(%q): got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEnvFile(%q): %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseEnvFile(%q): got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package sup
+
+import "github.com/pkg/errors"
+
+// Exit codes by the kind of failure, as in sysexits.h. Commands failing on
+// hosts exit with ExitCommand, whatever the remote status, so it can't be
+// mistaken for another kind; see ErrTaskFailed.ExitStatus for the status.
+// Failures of other kinds exit with 1.
+const (
+	ExitUsage   = 64 // Invalid arguments or flags.
+	ExitCommand = 65 // A command failed on some hosts.
+	ExitConnect = 69 // Hosts or bastions are unreachable, or connecting failed.
+	ExitLocked  = 75 // The network is locked by another run, see Lock.
+	ExitConfig  = 78 // Invalid Supfile, unknown network, command or target.
+
+	ExitInterrupted = 130 // Interrupted by SIGINT, as of shells.
+)
+
+// ExitCode returns the exit code of the error by its kind, or 1 if the kind
+// isn't known. Errors of the known kinds implement ExitCode() int, possibly
+// wrapped by github.com/pkg/errors.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	cause := errors.Cause(err)
+	switch cause {
+	case ErrUnknownNetwork, ErrNetworkNoHosts, ErrCmd:
+		return ExitConfig
+	case ErrInterrupted:
+		return ExitInterrupted
+	}
+	if e, ok := cause.(interface {
+		ExitCode() int
+	}); ok {
+		return e.ExitCode()
+	}
+	return 1
+}
+
+// errConfig marks errors of the Supfile's content not listed by
+// ErrInvalidSupfile, ie. unknown commands to be run.
+type errConfig struct {
+	error
+}
+
+func (e errConfig) ExitCode() int {
+	return ExitConfig
+}
@@ -0,0 +1,194 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Plan is the resolved execution plan of a target, or a command, on
+// a network, see Supfile.Plan. It's exported for review without running
+// anything, as JSON by WriteJSON or as a Graphviz graph by WriteDOT.
+type Plan struct {
+	Network  string              `json:"network"`
+	Target   string              `json:"target"`
+	Hosts    []string            `json:"hosts"`
+	Commands []PlanCommand       `json:"commands"`          // In the order they're run.
+	Targets  map[string][]string `json:"targets,omitempty"` // Entries of the targets expanded.
+}
+
+// PlanCommand is a command of the Plan.
+type PlanCommand struct {
+	Name      string   `json:"name"`
+	Desc      string   `json:"desc,omitempty"`
+	Stage     string   `json:"stage"` // "run", or "pre" and "post" of the network's pre and post commands.
+	Hosts     int      `json:"hosts"` // Number of hosts it's run on, 1 of local commands.
+	Local     bool     `json:"local,omitempty"`
+	Serial    int      `json:"serial,omitempty"`
+	When      string   `json:"when,omitempty"`
+	Requires  []string `json:"requires,omitempty"`
+	OnFailure string   `json:"on_failure,omitempty"`
+}
+
+// Plan resolves the execution plan of the target, or the command, on the
+// network; the default command if target is empty. Commands are ordered and
+// preceded by the ones they require as by ResolveCommands, the network's pre
+// and post commands included. The network's inventory, if any, is run to
+// count the hosts; nothing else is.
+func (conf *Supfile) Plan(network, target string) (Plan, error) {
+	if target == "" {
+		name, ok := conf.DefaultCommand()
+		if !ok {
+			return Plan{}, errConfig{errors.New("no target given and no default")}
+		}
+		target = name
+	}
+	n, err := conf.ResolveNetwork(network, nil)
+	if err != nil {
+		return Plan{}, err
+	}
+	vars, err := conf.EnvVars(n, nil)
+	if err != nil {
+		return Plan{}, errors.Wrapf(err, "network %v", network)
+	}
+	commands, err := conf.ResolveCommands(target)
+	if err != nil {
+		return Plan{}, err
+	}
+	pre, post, err := conf.networkHooks(n)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{
+		Network: network,
+		Target:  target,
+		Hosts:   n.Hosts,
+		Targets: make(map[string][]string),
+	}
+	for _, stage := range []struct {
+		name     string
+		commands []*Command
+	}{{"pre", pre}, {"run", commands}, {"post", post}} {
+		for _, cmd := range stage.commands {
+			cmd = n.withDefaults(cmd)
+			hosts := len(n.Hosts)
+			switch {
+			case cmd.Local != "" && !cmd.LocalPerHost, cmd.Once:
+				hosts = 1
+			case cmd.OncePer != "":
+				hosts = len(n.oncePer(n.Hosts, cmd.OncePer, vars))
+			}
+			plan.Commands = append(plan.Commands, PlanCommand{
+				Name:      cmd.Name,
+				Desc:      cmd.Desc,
+				Stage:     stage.name,
+				Hosts:     hosts,
+				Local:     cmd.Local != "",
+				Serial:    cmd.Serial,
+				When:      cmd.When,
+				Requires:  cmd.Requires,
+				OnFailure: cmd.OnFailure,
+			})
+		}
+	}
+	conf.planTargets(target, plan.Targets)
+	if len(plan.Targets) == 0 {
+		plan.Targets = nil
+	}
+	return plan, nil
+}
+
+// planTargets adds the entries of the target and of the targets it
+// references, recursively, to targets. Entries naming a command are the
+// command, as by withTarget.
+func (conf *Supfile) planTargets(name string, targets map[string][]string) {
+	if _, isCommand := conf.Commands.Get(name); isCommand {
+		return
+	}
+	entries, ok := conf.Targets.Get(name)
+	if !ok || targets[name] != nil {
+		return
+	}
+	targets[name] = entries
+	for _, entry := range entries {
+		conf.planTargets(entry, targets)
+	}
+}
+
+// WriteJSON writes the plan to w as indented JSON.
+func (p Plan) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// WriteDOT writes the plan to w as a Graphviz digraph: the network and the
+// targets point to the commands they run, numbered in order, and commands
+// point to the commands they require (dashed) and run on failure (dotted).
+func (p Plan) WriteDOT(w io.Writer) error {
+	id := func(kind, name string) string {
+		return strconv.Quote(kind + " " + name)
+	}
+	// Commands required by others are of the same stage.
+	node := func(stage, name string) string {
+		if stage == "run" {
+			return id("command", name)
+		}
+		return id(stage, name)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph %v {\n", strconv.Quote(p.Network+" "+p.Target))
+	fmt.Fprintf(&b, "\trankdir=LR;\n\tnode [shape=box];\n")
+	fmt.Fprintf(&b, "\t%v [shape=folder, label=%v];\n", id("network", p.Network), strconv.Quote(fmt.Sprintf("%v\n%v host(s)", p.Network, len(p.Hosts))))
+
+	for i, cmd := range p.Commands {
+		label := fmt.Sprintf("%v. %v\n%v host(s)", i+1, cmd.Name, cmd.Hosts)
+		if cmd.Local {
+			label = fmt.Sprintf("%v. %v\nlocal", i+1, cmd.Name)
+		}
+		fmt.Fprintf(&b, "\t%v [label=%v];\n", node(cmd.Stage, cmd.Name), strconv.Quote(label))
+		if cmd.Stage != "run" {
+			fmt.Fprintf(&b, "\t%v -> %v [label=%v];\n", id("network", p.Network), node(cmd.Stage, cmd.Name), strconv.Quote(cmd.Stage))
+		}
+		for _, required := range cmd.Requires {
+			fmt.Fprintf(&b, "\t%v -> %v [style=dashed, label=\"requires\"];\n", node(cmd.Stage, cmd.Name), node(cmd.Stage, required))
+		}
+		if cmd.OnFailure != "" {
+			fmt.Fprintf(&b, "\t%v -> %v [style=dotted, label=\"on_failure\"];\n", node(cmd.Stage, cmd.Name), id("on_failure", cmd.OnFailure))
+			fmt.Fprintf(&b, "\t%v [label=%v];\n", id("on_failure", cmd.OnFailure), strconv.Quote(cmd.OnFailure))
+		}
+	}
+
+	if len(p.Targets) == 0 {
+		fmt.Fprintf(&b, "\t%v -> %v;\n", id("network", p.Network), id("command", p.Target))
+	} else {
+		fmt.Fprintf(&b, "\t%v -> %v;\n", id("network", p.Network), id("target", p.Target))
+	}
+	var targets []string
+	for name := range p.Targets {
+		targets = append(targets, name)
+	}
+	for _, name := range sortedNames(targets) {
+		fmt.Fprintf(&b, "\t%v [shape=ellipse, label=%v];\n", id("target", name), strconv.Quote(name))
+		for _, entry := range p.Targets[name] {
+			if _, isTarget := p.Targets[entry]; isTarget {
+				fmt.Fprintf(&b, "\t%v -> %v;\n", id("target", name), id("target", entry))
+			} else {
+				fmt.Fprintf(&b, "\t%v -> %v;\n", id("target", name), id("command", entry))
+			}
+		}
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
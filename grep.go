@@ -0,0 +1,49 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// grepReader reads the lines of r matching re only, see Stackup.Grep.
+// Lines are passed on whole, once they end.
+type grepReader struct {
+	r       *bufio.Reader
+	re      *regexp.Regexp
+	matched func() // Called on every matching line.
+	line    []byte // Rest of the matching line being read.
+}
+
+// grep returns reader of the lines of the client's output r matching
+// the pattern of Grep, counted by the client's result, or r if unset.
+func (sup *Stackup) grep(c Client, r io.Reader) io.Reader {
+	if sup.grepRe == nil {
+		return r
+	}
+	g := &grepReader{r: bufio.NewReader(r), re: sup.grepRe}
+	if results := sup.results; results != nil {
+		g.matched = func() { results.matched(c) }
+	}
+	return g
+}
+
+func (g *grepReader) Read(p []byte) (int, error) {
+	for len(g.line) == 0 {
+		line, err := g.r.ReadBytes('\n')
+		if len(line) > 0 && g.re.Match(bytes.TrimRight(line, "\r\n")) {
+			if g.matched != nil {
+				g.matched()
+			}
+			g.line = line
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, g.line)
+	g.line = g.line[n:]
+	return n, nil
+}
@@ -0,0 +1,70 @@
+package sup
+
+import (
+	"sync"
+	"time"
+)
+
+// heartbeat prints a line per client still running a task periodically,
+// see Stackup.Heartbeat.
+type heartbeat struct {
+	start   time.Time
+	running map[Client]string // Clients still running and their prefixes.
+	stopCh  chan struct{}
+	mu      sync.Mutex
+}
+
+// startHeartbeat starts the heartbeat of the task's clients, if enabled.
+// It's disabled in JSON mode, as the heartbeat lines aren't JSON.
+func (sup *Stackup) startHeartbeat(task *Task, maxLen int) *heartbeat {
+	if sup.heartbeat <= 0 || sup.json != nil {
+		return nil
+	}
+	hb := &heartbeat{
+		start:   time.Now(),
+		running: make(map[Client]string, len(task.Clients)),
+		stopCh:  make(chan struct{}),
+	}
+	for _, c := range task.Clients {
+		hb.running[c] = sup.prefixOf(c, maxLen)
+	}
+
+	ticker := time.NewTicker(sup.heartbeat)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				elapsed := time.Since(hb.start).Round(time.Second)
+				hb.mu.Lock()
+				for _, c := range task.Clients {
+					if prefix, ok := hb.running[c]; ok {
+						sup.log.logf(LevelInfo, prefix, "still running (%v elapsed)", elapsed)
+					}
+				}
+				hb.mu.Unlock()
+			case <-hb.stopCh:
+				return
+			}
+		}
+	}()
+	return hb
+}
+
+// done ends the heartbeat of the client, which finished the task.
+func (hb *heartbeat) done(c Client) {
+	if hb == nil {
+		return
+	}
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	delete(hb.running, c)
+}
+
+// stop stops the heartbeat.
+func (hb *heartbeat) stop() {
+	if hb == nil {
+		return
+	}
+	close(hb.stopCh)
+}
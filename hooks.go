@@ -0,0 +1,164 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Hooks are external programs run locally at points of every run, ie. for
+// metrics, locking or custom notifications. Each hook is run by /bin/sh,
+// given the point's context as $SUP_* env vars and as JSON on STDIN, see
+// hookEvent. A failing start hook aborts the run; the others only warn.
+type Hooks struct {
+	RunStart     []string `yaml:"run_start"`     // Before connecting to the hosts.
+	HostStart    []string `yaml:"host_start"`    // Per host, before the commands run on it.
+	HostComplete []string `yaml:"host_complete"` // Per host, after the commands ran on it.
+	RunComplete  []string `yaml:"run_complete"`  // After the run, even if it failed.
+}
+
+// merge overrides the hooks of the points other has hooks of.
+func (h *Hooks) merge(other Hooks) {
+	for _, hooks := range []struct{ dst, src *[]string }{
+		{&h.RunStart, &other.RunStart},
+		{&h.HostStart, &other.HostStart},
+		{&h.HostComplete, &other.HostComplete},
+		{&h.RunComplete, &other.RunComplete},
+	} {
+		if len(*hooks.src) > 0 {
+			*hooks.dst = *hooks.src
+		}
+	}
+}
+
+// hookEvent is the context of a hook, fed to its STDIN as JSON.
+type hookEvent struct {
+	Hook     string   `json:"hook"` // ie. "host_start".
+	Networks []string `json:"networks"`
+	Host     string   `json:"host,omitempty"` // Of host hooks.
+	Commands []string `json:"commands"`
+	Success  *bool    `json:"success,omitempty"` // Of complete hooks.
+	Error    string   `json:"error,omitempty"`
+
+	// Commands failed on the host, of host_complete hooks.
+	FailedCommands []string `json:"failed_commands,omitempty"`
+
+	// Results of the run, of run_complete hooks, as posted by notify.
+	Results *notification `json:"results,omitempty"`
+}
+
+// env returns the env vars of the event: $SUP_HOOK, $SUP_NETWORK (comma
+// separated networks of run hooks), $SUP_HOST and $SUP_SUCCESS.
+func (e hookEvent) env() []string {
+	env := []string{
+		"SUP_HOOK=" + e.Hook,
+		"SUP_NETWORK=" + strings.Join(e.Networks, ","),
+	}
+	if e.Host != "" {
+		env = append(env, "SUP_HOST="+e.Host)
+	}
+	if e.Success != nil {
+		env = append(env, "SUP_SUCCESS="+strconv.FormatBool(*e.Success))
+	}
+	return env
+}
+
+// newHookEvent returns event of the hook point of the commands run on
+// the networks, finished with err if it's a complete hook.
+func newHookEvent(hook string, networks []*Network, commands []*Command, err error) hookEvent {
+	e := hookEvent{Hook: hook}
+	for _, network := range networks {
+		e.Networks = append(e.Networks, network.Name)
+	}
+	for _, cmd := range commands {
+		e.Commands = append(e.Commands, cmd.Name)
+	}
+	if strings.HasSuffix(hook, "_complete") {
+		success := err == nil
+		e.Success = &success
+		if err != nil {
+			e.Error = err.Error()
+		}
+	}
+	return e
+}
+
+// runHooks runs the hooks of the event one after another, with the env vars
+// added to sup's environment, logging their output. It stops on the first
+// failing hook. Hooks aren't run in dry-run mode.
+func (sup *Stackup) runHooks(hooks []string, event hookEvent, env EnvList) error {
+	if len(hooks) == 0 || sup.dryRun {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		cmd := shellCommand("", "/bin/sh", hook)
+		cmd.Env = append(append(os.Environ(), env.Slice()...), event.env()...)
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.CombinedOutput()
+		if output := strings.TrimRight(string(out), "\n"); output != "" {
+			for _, line := range strings.Split(output, "\n") {
+				sup.log.Infof("%v hook: %v", event.Hook, line)
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%v hook %q failed", event.Hook, hook)
+		}
+	}
+	return nil
+}
+
+// runHostHooks runs the hooks of the event per host of the network, in the
+// network's order. Complete hooks are given the commands failed on the host
+// by the summary since n. It stops on the first failing hook.
+func (sup *Stackup) runHostHooks(hooks []string, event hookEvent, network *Network, env EnvList, clientHosts map[Client]string, n int) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	hostClients := make(map[string]Client, len(clientHosts))
+	for c, host := range clientHosts {
+		hostClients[host] = c
+	}
+	for _, host := range network.Hosts {
+		c, ok := hostClients[host]
+		if !ok {
+			continue
+		}
+		hostEvent := event
+		hostEvent.Host = host
+		if event.Success != nil {
+			hostEvent.FailedCommands = failedCommands(sup.summary[n:], c.Host())
+			success := len(hostEvent.FailedCommands) == 0
+			hostEvent.Success = &success
+			if success {
+				hostEvent.Error = ""
+			}
+		}
+		hostEnv := append(env[:len(env):len(env)], network.HostEnv[host]...)
+		if err := sup.runHooks(hooks, hostEvent, hostEnv); err != nil {
+			return errors.Wrap(err, host)
+		}
+	}
+	return nil
+}
+
+// failedCommands returns the commands of the summary failed on the host.
+func failedCommands(summary []commandSummary, host string) []string {
+	var failed []string
+	for _, s := range summary {
+		for _, h := range s.failed {
+			if h == host {
+				failed = append(failed, s.cmd)
+				break
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,166 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHostLogName is the default file name template of the host logs.
+const DefaultHostLogName = "{{.Host}}.log"
+
+// hostLogData is the data of the host logs' file name template.
+type hostLogData struct {
+	Host    string
+	Network string
+	Time    time.Time // Start of the run.
+}
+
+// hostLogs writes the commands' output of a run to a file per host,
+// see Stackup.HostLogs.
+type hostLogs struct {
+	dir     string
+	name    *template.Template
+	start   time.Time
+	network string // Network being run on.
+	files   map[string]*hostLog
+	log     *Logger
+	mu      sync.Mutex
+}
+
+// hostLog is a host's log file. Failing to open or write it is reported
+// once; the run goes on.
+type hostLog struct {
+	path   string
+	f      *os.File
+	cmd    string // Command of the last output written.
+	failed bool
+	log    *Logger
+	mu     sync.Mutex
+}
+
+// openHostLogs starts the host logs of the run started at start, if enabled,
+// creating their directory.
+func (sup *Stackup) openHostLogs(start time.Time) error {
+	sup.logs = nil
+	if sup.hostLogDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(sup.hostLogDir, 0755); err != nil {
+		return errors.Wrap(err, "creating host logs directory failed")
+	}
+	sup.logs = &hostLogs{
+		dir:   sup.hostLogDir,
+		name:  sup.hostLogName,
+		start: start,
+		files: make(map[string]*hostLog),
+		log:   sup.log,
+	}
+	return nil
+}
+
+// closeHostLogs closes the host logs of the run, if any.
+func (sup *Stackup) closeHostLogs() {
+	if sup.logs == nil {
+		return
+	}
+	for _, l := range sup.logs.files {
+		if l.f == nil {
+			continue
+		}
+		if err := l.f.Close(); err != nil && !l.failed {
+			sup.log.Errorf("%v", errors.Wrapf(err, "closing host log %v failed", l.path))
+		}
+	}
+	sup.logs = nil
+}
+
+// tee returns reader of the client's output r, writing it to the client's
+// host log too, preceded by the command's name once. Without host logs,
+// it's r.
+func (logs *hostLogs) tee(c Client, cmd string, r io.Reader) io.Reader {
+	if logs == nil {
+		return r
+	}
+	return io.TeeReader(r, &hostLogWriter{logs.of(c), cmd})
+}
+
+// of returns the host log of the client, opened on the first call.
+func (logs *hostLogs) of(c Client) *hostLog {
+	host := c.Host()
+	if local, ok := c.(*LocalhostClient); ok && local.target != nil {
+		host = local.target.Host()
+	}
+
+	var buf bytes.Buffer
+	var path string
+	err := logs.name.Execute(&buf, hostLogData{Host: host, Network: logs.network, Time: logs.start})
+	if err == nil {
+		path = filepath.Join(logs.dir, buf.String())
+	}
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if l, ok := logs.files[path]; ok {
+		return l
+	}
+	l := &hostLog{path: path, log: logs.log}
+	logs.files[path] = l
+	if err != nil {
+		l.fail(errors.Wrapf(err, "host log of %v", host))
+		return l
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		l.fail(errors.Wrapf(err, "creating host log %v failed", path))
+		return l
+	}
+	if l.f, err = os.Create(path); err != nil {
+		l.fail(errors.Wrap(err, "creating host log failed"))
+	}
+	return l
+}
+
+// fail reports the error of the host log and disables it.
+func (l *hostLog) fail(err error) {
+	l.failed = true
+	l.log.Errorf("%v", err)
+}
+
+// write writes output of the command, preceded by its name if it's
+// the first output of the command.
+func (l *hostLog) write(cmd string, p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed {
+		return
+	}
+	if cmd != l.cmd {
+		l.cmd = cmd
+		if _, err := fmt.Fprintf(l.f, "==> %v\n", cmd); err != nil {
+			l.fail(errors.Wrapf(err, "writing host log %v failed", l.path))
+			return
+		}
+	}
+	if _, err := l.f.Write(p); err != nil {
+		l.fail(errors.Wrapf(err, "writing host log %v failed", l.path))
+	}
+}
+
+// hostLogWriter writes output of the command to the host log. It never
+// fails, so the output is streamed even if the host log can't be written.
+type hostLogWriter struct {
+	log *hostLog
+	cmd string
+}
+
+func (w *hostLogWriter) Write(p []byte) (int, error) {
+	w.log.write(w.cmd, p)
+	return len(p), nil
+}
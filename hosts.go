@@ -0,0 +1,171 @@
+package sup
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var hostRangeRe = regexp.MustCompile(`^(\d+)-(\d+)$`)
+
+// expandHost expands ranges, ie. "web[01-20].example.com", and sets,
+// ie. "web{1,2,3}.example.com", in the host in order, dropping duplicates.
+// Brackets not enclosing a numeric range, ie. of IPv6 addresses,
+// and braces without a comma are kept as they are.
+func expandHost(host string) ([]string, error) {
+	expanded, err := expandHostGroups(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	seen := make(map[string]bool, len(expanded))
+	for _, host := range expanded {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+func expandHostGroups(host string) ([]string, error) {
+	for i := 0; i < len(host); i++ {
+		var alts []string
+		var end int
+
+		switch host[i] {
+		case '[':
+			j := strings.IndexByte(host[i:], ']')
+			if j < 0 {
+				continue
+			}
+			end = i + j
+			m := hostRangeRe.FindStringSubmatch(host[i+1 : end])
+			if m == nil {
+				continue
+			}
+			var err error
+			alts, err = hostRange(m[1], m[2])
+			if err != nil {
+				return nil, fmt.Errorf("host %q: %v", host, err)
+			}
+		case '{':
+			end = matchingBrace(host, i)
+			if end < 0 {
+				continue
+			}
+			alts = splitHostSet(host[i+1 : end])
+			if len(alts) < 2 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		// Expand the rest of the host for every alternative,
+		// including groups nested in the alternative.
+		var hosts []string
+		for _, alt := range alts {
+			tails, err := expandHostGroups(alt + host[end+1:])
+			if err != nil {
+				return nil, err
+			}
+			for _, tail := range tails {
+				hosts = append(hosts, host[:i]+tail)
+			}
+		}
+		return hosts, nil
+	}
+
+	return []string{host}, nil
+}
+
+// hostRange returns numbers from lo to hi, zero padded to the width of lo
+// if lo has a leading zero, ie. "01" to "20".
+func hostRange(lo, hi string) ([]string, error) {
+	from, err := strconv.Atoi(lo)
+	if err != nil {
+		return nil, err
+	}
+	to, err := strconv.Atoi(hi)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid range [%v-%v]", lo, hi)
+	}
+
+	format := "%d"
+	if len(lo) > 1 && lo[0] == '0' {
+		format = "%0" + strconv.Itoa(len(lo)) + "d"
+	}
+	nums := make([]string, 0, to-from+1)
+	for n := from; n <= to; n++ {
+		nums = append(nums, fmt.Sprintf(format, n))
+	}
+	return nums, nil
+}
+
+// matchingBrace returns index of the brace closing the one at i, or -1.
+func matchingBrace(s string, i int) int {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// splitHostSet splits the set by its top-level commas.
+func splitHostSet(set string) []string {
+	var alts []string
+	depth, start := 0, 0
+	for j := 0; j < len(set); j++ {
+		switch set[j] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alts = append(alts, set[start:j])
+				start = j + 1
+			}
+		}
+	}
+	return append(alts, set[start:])
+}
+
+// hostAliasRe matches hosts looking like aliases, ie. "db-primary".
+var hostAliasRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// hostAlias returns the address of the host alias, ie. "db-primary" for
+// "postgres@10.0.3.14:5432", or the host as it is if it's no alias.
+// Env vars of the address are expanded by vars, resolved on demand.
+// Hosts looking like aliases, but not defined, are an error if strict.
+func (conf *Supfile) hostAlias(host string, vars func() (EnvList, error)) (string, error) {
+	addr, ok := conf.Hosts[host]
+	if !ok {
+		if conf.StrictHosts && host != "localhost" && hostAliasRe.MatchString(host) {
+			return "", fmt.Errorf("unknown host alias %q", host)
+		}
+		return host, nil
+	}
+	if !strings.Contains(addr, "$") {
+		return addr, nil
+	}
+	env, err := vars()
+	if err != nil {
+		return "", err
+	}
+	return expandVars(addr, env)
+}
@@ -0,0 +1,194 @@
+package sup
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UploadStateFile records when incremental uploads last succeeded on
+// the hosts, relative to the CWD.
+const UploadStateFile = ".sup-uploads.json"
+
+// uploadState is the content of the UploadStateFile: start times of the last
+// successful uploads by "host dst src" keys, see uploadKey.
+type uploadState struct {
+	file    string
+	times   map[string]time.Time
+	changed bool
+	mu      sync.Mutex
+}
+
+// loadUploadState loads the state file in cwd, if it exists.
+func loadUploadState(cwd string) (*uploadState, error) {
+	state := &uploadState{
+		file:  filepath.Join(cwd, UploadStateFile),
+		times: make(map[string]time.Time),
+	}
+	data, err := ioutil.ReadFile(state.file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state.times); err != nil {
+		return nil, errors.Wrapf(err, "parsing %v failed", UploadStateFile)
+	}
+	return state, nil
+}
+
+// loadUploadState returns the state of incremental uploads, loading it
+// from the state file in cwd once.
+func (sup *Stackup) loadUploadState(cwd string) (*uploadState, error) {
+	if sup.uploads == nil {
+		state, err := loadUploadState(cwd)
+		if err != nil {
+			return nil, err
+		}
+		sup.uploads = state
+	}
+	return sup.uploads, nil
+}
+
+// since returns the time of the last upload of the key on all the hosts,
+// or zero if any of them has none.
+func (state *uploadState) since(keys []string) time.Time {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var since time.Time
+	for _, key := range keys {
+		t, ok := state.times[key]
+		if !ok {
+			return time.Time{}
+		}
+		if since.IsZero() || t.Before(since) {
+			since = t
+		}
+	}
+	return since
+}
+
+// record records the upload of the key started at start succeeded.
+func (state *uploadState) record(key string, start time.Time) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.times[key] = start
+	state.changed = true
+}
+
+// save writes the state file, if anything was recorded since loaded.
+func (state *uploadState) save() error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.changed {
+		return nil
+	}
+	data, err := json.MarshalIndent(state.times, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(state.file, append(data, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "writing %v failed", UploadStateFile)
+	}
+	state.changed = false
+	return nil
+}
+
+// uploadRecord records successful uploads of a task on its clients.
+type uploadRecord struct {
+	state *uploadState
+	keys  map[Client]string
+	start time.Time
+}
+
+// done records the upload succeeded on the client.
+func (r *uploadRecord) done(c Client) {
+	if r == nil {
+		return
+	}
+	if key, ok := r.keys[c]; ok {
+		r.state.record(key, r.start)
+	}
+}
+
+// uploadKey keys the upload to the host in the state file, by its dst
+// expanded by the host's env vars, so uploads to new dirs, ie. of a new
+// $VERSION, are full.
+func uploadKey(upload Upload, data templateData) (string, error) {
+	dst, err := expandEnv(upload.Dst, func(name string) (string, bool, error) {
+		if value, ok := data.Env[name]; ok {
+			return value, true, nil
+		}
+		return os.Getenv(name), true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return data.Host + " " + dst + " " + upload.name(), nil
+}
+
+// changedFiles returns the regular files of the paths, relative to cwd,
+// modified after since, skipping the excluded ones.
+func changedFiles(cwd string, paths []string, exclude string, since time.Time) ([]string, error) {
+	var excludes []string
+	for _, pattern := range strings.Split(exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			excludes = append(excludes, pattern)
+		}
+	}
+
+	var files []string
+	for _, path := range paths {
+		root := path
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(cwd, root)
+		}
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(path, strings.TrimPrefix(file, root))
+			if excluded(filepath.ToSlash(name), excludes) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() && info.ModTime().After(since) {
+				files = append(files, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "listing changed files failed")
+		}
+	}
+	return files, nil
+}
+
+// newTarFilesReader creates a tar stream reader of the files, relative
+// to cwd, listed to tar by STDIN, as there may be too many for arguments.
+func newTarFilesReader(cwd string, files []string, exclude string, compress bool) (io.Reader, error) {
+	cmd := exec.Command("tar", append(localTarArgs(nil, exclude, compress), "-T", "-")...)
+	cmd.Dir = cwd
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "tar: stdout pipe failed")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "tar: starting cmd failed")
+	}
+
+	return stdout, nil
+}
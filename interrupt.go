@@ -0,0 +1,135 @@
+package sup
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInterrupted is returned by runs interrupted by SIGINT, once the work
+// in flight finished.
+var ErrInterrupted = errors.New("interrupted")
+
+// errAborted fails uploads in flight of interrupted runs.
+var errAborted = errors.New("upload aborted: interrupted")
+
+// interrupts handles SIGINT of a run. The first one cancels the run's
+// context: no more commands, batches of hosts or connections are started,
+// uploads in flight are aborted and the other tasks in flight finish, or time
+// out. The subsequent ones interrupt the tasks in flight. Tasks reading sup's
+// STDIN are interrupted by the first one already, as they're interactive.
+type interrupts struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	trap    chan os.Signal
+	running map[*Task]bool
+	mu      sync.Mutex
+}
+
+// trapInterrupts handles SIGINT of the run until stopped.
+func (sup *Stackup) trapInterrupts() *interrupts {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := &interrupts{
+		ctx:     ctx,
+		cancel:  cancel,
+		trap:    make(chan os.Signal, 1),
+		running: make(map[*Task]bool),
+	}
+	signal.Notify(in.trap, os.Interrupt)
+	go func() {
+		for sig := range in.trap {
+			first := ctx.Err() == nil
+			if first {
+				sup.log.Warnf("Interrupted: waiting for the running commands, not starting new ones; interrupt again to stop them")
+				cancel()
+			}
+			in.mu.Lock()
+			for task := range in.running {
+				if first && task.Input != os.Stdin {
+					continue
+				}
+				for _, c := range task.Clients {
+					if err := c.Signal(sig); err != nil {
+						sup.log.Errorf("%v", errors.Wrap(err, "sending signal failed"))
+					}
+				}
+			}
+			in.mu.Unlock()
+		}
+	}()
+	return in
+}
+
+// stop stops handling SIGINT.
+func (in *interrupts) stop() {
+	if in == nil {
+		return
+	}
+	signal.Stop(in.trap)
+	close(in.trap)
+	in.cancel()
+}
+
+// interrupted reports whether the run was interrupted.
+func (in *interrupts) interrupted() bool {
+	return in != nil && in.ctx.Err() != nil
+}
+
+// sleep waits for the duration, unless the run is interrupted meanwhile.
+// It reports whether the duration passed uninterrupted.
+func (in *interrupts) sleep(d time.Duration) bool {
+	if in == nil {
+		time.Sleep(d)
+		return true
+	}
+	if in.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case <-in.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// start tracks the task running, to be interrupted, until done is called.
+func (in *interrupts) start(task *Task) (done func()) {
+	if in == nil {
+		return func() {}
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.running[task] = true
+	return func() {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		delete(in.running, task)
+	}
+}
+
+// abortable returns reader of r failing once the run is interrupted,
+// ie. to abort uploads in flight.
+func (in *interrupts) abortable(r io.Reader) io.Reader {
+	if in == nil || r == nil {
+		return r
+	}
+	return &abortableReader{ctx: in.ctx, r: r}
+}
+
+type abortableReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (a *abortableReader) Read(p []byte) (int, error) {
+	if err := a.ctx.Err(); err != nil {
+		return 0, errAborted
+	}
+	return a.r.Read(p)
+}
@@ -0,0 +1,105 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// inventoryCache is the content of the network's inventory_cache file.
+type inventoryCache struct {
+	Key   string   `json:"key"` // Hash of the inventory command and its env vars.
+	Hosts []string `json:"hosts"`
+}
+
+// resolveInventoryFiles resolves relative inventory_file paths of the
+// networks against dir.
+func (conf *Supfile) resolveInventoryFiles(dir string) {
+	for name, network := range conf.Networks.nets {
+		if network.InventoryFile == "" || filepath.IsAbs(network.InventoryFile) {
+			continue
+		}
+		network.InventoryFile = filepath.Join(dir, network.InventoryFile)
+		conf.Networks.nets[name] = network
+	}
+}
+
+// inventoryCacheTTL parses the network's inventory_cache_ttl.
+// Zero means the cache doesn't expire.
+func (n Network) inventoryCacheTTL() (time.Duration, error) {
+	if n.InventoryCacheTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(n.InventoryCacheTTL)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid inventory_cache_ttl %q", n.InventoryCacheTTL)
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("invalid inventory_cache_ttl %q: must not be negative", n.InventoryCacheTTL)
+	}
+	return ttl, nil
+}
+
+// inventoryCacheKey hashes the inventory command and the env vars
+// it's run with, except $SUP_TIME changing on every run.
+func (n Network) inventoryCacheKey(env map[string]string) string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		if key != "SUP_TIME" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", n.Inventory)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%q=%q\n", key, env[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedInventory returns hosts of the inventory cache, unless it's missing,
+// expired, corrupt, of another command or env vars, or to be refreshed.
+func (n Network) cachedInventory(key string) ([]string, bool) {
+	if n.InventoryCache == "" || n.RefreshInventory {
+		return nil, false
+	}
+	info, err := os.Stat(n.InventoryCache)
+	if err != nil {
+		return nil, false
+	}
+	if ttl, _ := n.inventoryCacheTTL(); ttl > 0 && time.Since(info.ModTime()) > ttl {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(n.InventoryCache)
+	if err != nil {
+		return nil, false
+	}
+	var cache inventoryCache
+	if err := json.Unmarshal(data, &cache); err != nil || cache.Key != key {
+		return nil, false
+	}
+	return cache.Hosts, true
+}
+
+// cacheInventory writes hosts listed by the inventory command to the
+// inventory cache, if any.
+func (n Network) cacheInventory(key string, hosts []string) error {
+	if n.InventoryCache == "" {
+		return nil
+	}
+	data, err := json.Marshal(inventoryCache{Key: key, Hosts: hosts})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(n.InventoryCache, data, 0644)
+}
@@ -0,0 +1,305 @@
+package sup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Ansible's numeric host ranges, ie. "web[01:20].example.com", and
+// the others, ie. alphabetic or with a stride.
+var (
+	iniRangeRe      = regexp.MustCompile(`\[(\d+):(\d+)\]`)
+	iniOtherRangeRe = regexp.MustCompile(`\[[^\]]*:[^\]]*\]`)
+)
+
+// iniInventory is an Ansible-style INI inventory, see parseInventoryINI.
+type iniInventory struct {
+	hosts    []string // In order of appearance.
+	groups   map[string]*iniGroup
+	order    []string // Groups in order of appearance.
+	hostVars map[string]EnvList
+	warnings []string
+}
+
+type iniGroup struct {
+	hosts    []string
+	children []string
+	vars     EnvList
+}
+
+// parseInventoryINI returns host entries of the Ansible-style INI inventory's
+// group, or all of its hosts if group is empty, as "user@host:port KEY=value
+// ...". The hosts' addresses are set by ansible_host, ansible_port and
+// ansible_user; the other vars of the groups, in order, and of the hosts
+// are the hosts' env vars. Unsupported syntax is skipped, returning warnings.
+func parseInventoryINI(data []byte, group string) ([]string, []string, error) {
+	inv := &iniInventory{
+		groups:   make(map[string]*iniGroup),
+		hostVars: make(map[string]EnvList),
+	}
+	inv.parse(data)
+
+	var hosts []string
+	if group == "" || group == "all" {
+		hosts = inv.hosts
+	} else {
+		if _, ok := inv.groups[group]; !ok {
+			return nil, inv.warnings, fmt.Errorf("unknown inventory group %q", group)
+		}
+		hosts = inv.groupHosts(group, make(map[string]bool))
+	}
+
+	// Vars of all the groups the hosts are in, overridden by the hosts' ones.
+	vars := make(map[string]EnvList, len(hosts))
+	names := []string{"all"}
+	for _, name := range inv.order {
+		if name != "all" {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		g, ok := inv.groups[name]
+		if !ok || len(g.vars) == 0 {
+			continue
+		}
+		members := inv.hosts
+		if name != "all" {
+			members = inv.groupHosts(name, make(map[string]bool))
+		}
+		for _, host := range members {
+			env := vars[host]
+			for _, v := range g.vars {
+				env.Set(v.Key, v.Value)
+			}
+			vars[host] = env
+		}
+	}
+
+	entries := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		env := vars[host]
+		for _, v := range inv.hostVars[host] {
+			env.Set(v.Key, v.Value)
+		}
+		entries = append(entries, inv.entry(host, env))
+	}
+	return entries, inv.warnings, nil
+}
+
+// parse parses the inventory's sections and lines.
+func (inv *iniInventory) parse(data []byte) {
+	section, kind := "ungrouped", "hosts"
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		warnf := func(format string, args ...interface{}) {
+			inv.warnings = append(inv.warnings, fmt.Sprintf("line %v: ", i+1)+fmt.Sprintf(format, args...))
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section, kind = line[1:len(line)-1], "hosts"
+			if j := strings.Index(section, ":"); j >= 0 {
+				section, kind = section[:j], section[j+1:]
+			}
+			switch kind {
+			case "hosts", "vars", "children":
+				inv.group(section)
+			default:
+				warnf("ignoring unsupported section [%v:%v]", section, kind)
+			}
+			continue
+		}
+
+		switch kind {
+		case "hosts":
+			inv.parseHost(line, section, warnf)
+		case "children":
+			g := inv.group(section)
+			g.children = append(g.children, strings.Fields(line)[0])
+		case "vars":
+			j := strings.Index(line, "=")
+			if j < 1 {
+				warnf("ignoring %q: expected key=value", line)
+				continue
+			}
+			key, value := strings.TrimSpace(line[:j]), unquoteINI(strings.TrimSpace(line[j+1:]))
+			if inv.validVar(key, value, warnf) {
+				inv.group(section).vars.Set(key, value)
+			}
+		}
+	}
+}
+
+// parseHost parses the host line of the group, ie. "web1 ansible_port=2222".
+func (inv *iniInventory) parseHost(line, group string, warnf func(string, ...interface{})) {
+	fields := splitINI(line)
+	host := fields[0]
+	if strings.Contains(host, "=") {
+		warnf("ignoring %q: expected host name", line)
+		return
+	}
+	host = iniRangeRe.ReplaceAllString(host, "[$1-$2]")
+	if iniOtherRangeRe.MatchString(host) {
+		warnf("ignoring host %v: only numeric ranges, ie. [01:20], are supported", host)
+		return
+	}
+
+	g := inv.group(group)
+	if !contains(g.hosts, host) {
+		g.hosts = append(g.hosts, host)
+	}
+	if _, ok := inv.hostVars[host]; !ok {
+		inv.hosts = append(inv.hosts, host)
+		inv.hostVars[host] = nil
+	}
+	for _, field := range fields[1:] {
+		if field[0] == '#' {
+			break
+		}
+		j := strings.Index(field, "=")
+		if j < 1 {
+			warnf("host %v: ignoring %q: expected key=value", host, field)
+			continue
+		}
+		key, value := field[:j], unquoteINI(field[j+1:])
+		if inv.validVar(key, value, warnf) {
+			env := inv.hostVars[host]
+			env.Set(key, value)
+			inv.hostVars[host] = env
+		}
+	}
+}
+
+// validVar reports whether the var can be an env var of the hosts,
+// or their address.
+func (inv *iniInventory) validVar(key, value string, warnf func(string, ...interface{})) bool {
+	switch {
+	case strings.HasPrefix(key, "ansible_") && !iniAddressVars[key]:
+		warnf("ignoring unsupported %v", key)
+	case !isEnvName(key) || runtimeEnv[key]:
+		warnf("ignoring %v: invalid env var name", key)
+	case strings.ContainsAny(value, " \t"):
+		warnf("ignoring %v: values with whitespace aren't supported", key)
+	default:
+		return true
+	}
+	return false
+}
+
+// iniAddressVars are the vars setting the hosts' addresses.
+var iniAddressVars = map[string]bool{
+	"ansible_host":     true,
+	"ansible_port":     true,
+	"ansible_user":     true,
+	"ansible_ssh_host": true,
+	"ansible_ssh_port": true,
+	"ansible_ssh_user": true,
+}
+
+// entry returns the host entry of the host and its vars.
+func (inv *iniInventory) entry(host string, vars EnvList) string {
+	addr, port, user := host, "", ""
+	var env []string
+	for _, v := range vars {
+		switch v.Key {
+		case "ansible_host", "ansible_ssh_host":
+			addr = v.Value
+		case "ansible_port", "ansible_ssh_port":
+			port = v.Value
+		case "ansible_user", "ansible_ssh_user":
+			user = v.Value
+		default:
+			env = append(env, v.Key+"="+v.Value)
+		}
+	}
+	if user != "" {
+		addr = user + "@" + addr
+	}
+	if port != "" {
+		addr += ":" + port
+	}
+	return strings.Join(append([]string{addr}, env...), " ")
+}
+
+// group returns the named group, adding it if it's new.
+func (inv *iniInventory) group(name string) *iniGroup {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = &iniGroup{}
+		inv.groups[name] = g
+		inv.order = append(inv.order, name)
+	}
+	return g
+}
+
+// groupHosts returns hosts of the group and of its children, in order,
+// skipping groups already seen.
+func (inv *iniInventory) groupHosts(name string, seen map[string]bool) []string {
+	g, ok := inv.groups[name]
+	if !ok || seen[name] {
+		return nil
+	}
+	seen[name] = true
+	hosts := append([]string{}, g.hosts...)
+	for _, child := range g.children {
+		for _, host := range inv.groupHosts(child, seen) {
+			if !contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+// splitINI splits the line to fields separated by whitespace, keeping
+// quoted values, ie. `motd="Hello world"`, in one field.
+func splitINI(line string) []string {
+	var fields []string
+	var field []byte
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			field = append(field, c)
+		case c == '"' || c == '\'':
+			quote = c
+			field = append(field, c)
+		case c == ' ' || c == '\t':
+			if len(field) > 0 {
+				fields = append(fields, string(field))
+				field = nil
+			}
+		default:
+			field = append(field, c)
+		}
+	}
+	if len(field) > 0 {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
+
+// unquoteINI strips the quotes enclosing the value, if any.
+func unquoteINI(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// contains reports whether the list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
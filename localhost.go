@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -19,6 +20,7 @@ type LocalhostClient struct {
 	stderr  io.Reader
 	running bool
 	env     string //export FOO="bar"; export BAR="baz";
+	target  Client // Host the local command is run for, if run per host.
 }
 
 func (c *LocalhostClient) Connect(_ string) error {
@@ -38,7 +40,7 @@ func (c *LocalhostClient) Run(task *Task) error {
 		return fmt.Errorf("Command already running")
 	}
 
-	cmd := exec.Command("bash", "-c", c.env+task.Run)
+	cmd := shellCommand(task.localShell, "bash", task.command(c, c.env))
 	c.cmd = cmd
 
 	c.stdout, err = cmd.StdoutPipe()
@@ -91,9 +93,16 @@ func (c *LocalhostClient) Stdout() io.Reader {
 
 func (c *LocalhostClient) Prefix() (string, int) {
 	host := c.user + "@localhost" + " | "
+	if c.target != nil {
+		host = c.user + "@localhost > " + c.target.Host() + " | "
+	}
 	return ResetColor + host, len(host)
 }
 
+func (c *LocalhostClient) Host() string {
+	return "localhost"
+}
+
 func (c *LocalhostClient) Write(p []byte) (n int, err error) {
 	return c.stdin.Write(p)
 }
@@ -117,3 +126,13 @@ func ResolveLocalPath(cwd, path, env string) (string, error) {
 
 	return string(resolvedFilename), nil
 }
+
+// shellCommand returns the command running the script by the local shell,
+// ie. "/bin/zsh" or "bash -e", or by def if the shell isn't set.
+func shellCommand(shell, def, script string) *exec.Cmd {
+	args := strings.Fields(shell)
+	if len(args) == 0 {
+		args = []string{def}
+	}
+	return exec.Command(args[0], append(args[1:], "-c", script)...)
+}
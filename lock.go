@@ -0,0 +1,170 @@
+package sup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lockRetryInterval is the interval of retrying to acquire a lock held by
+// another run, until the lock's timeout.
+var lockRetryInterval = time.Second
+
+// ErrLocked is returned when the lock of the network is held by another run,
+// see Lock.
+type ErrLocked struct {
+	Network string
+	Holder  string // Run holding the lock, as recorded by it; empty if unknown.
+	File    string // Lock file, if it's one.
+}
+
+func (e ErrLocked) Error() string {
+	msg := fmt.Sprintf("network %v is locked by %v, refusing to run", e.Network, e.holder())
+	if e.File != "" {
+		msg += fmt.Sprintf("; remove the lock file %v if the run is gone", e.File)
+	}
+	return msg
+}
+
+func (e ErrLocked) holder() string {
+	if e.Holder == "" {
+		return "another run"
+	}
+	return e.Holder
+}
+
+func (e ErrLocked) ExitCode() int {
+	return ExitLocked
+}
+
+// timeout parses the lock's timeout. Zero means runs don't wait for it.
+func (l *Lock) timeout() (time.Duration, error) {
+	if l.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(l.Timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid timeout %q", l.Timeout)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must not be negative", l.Timeout)
+	}
+	return timeout, nil
+}
+
+// lockOwner describes the run holding a lock, ie. "alice@laptop (pid 42)
+// since 2016-01-02T15:04:05Z".
+func lockOwner() string {
+	name, host := "unknown", "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if h, err := os.Hostname(); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("%v@%v (pid %v) since %v", name, host, os.Getpid(), time.Now().Format(time.RFC3339))
+}
+
+// acquireLock acquires the lock of the network, retrying while another run
+// holds it until the lock's timeout, and returns the func releasing it.
+func (sup *Stackup) acquireLock(network *Network, vars EnvList) (release func() error, err error) {
+	lock := network.Lock
+	timeout, err := lock.timeout()
+	if err != nil {
+		return nil, errors.Wrapf(err, "network %v: lock", network.Name)
+	}
+	owner := lockOwner()
+
+	var file string
+	if lock.File != "" {
+		if file, err = expandVars(lock.File, vars); err != nil {
+			return nil, errors.Wrapf(err, "network %v: lock file", network.Name)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		var holder string
+		if file != "" {
+			release, holder, err = lockFile(file, owner)
+		} else {
+			release, holder, err = lockCommand(network, vars, owner)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "network %v: acquiring lock failed", network.Name)
+		}
+		if release != nil {
+			return release, nil
+		}
+
+		locked := ErrLocked{Network: network.Name, Holder: holder, File: file}
+		if !time.Now().Before(deadline) {
+			return nil, locked
+		}
+		if attempt == 1 {
+			sup.log.Warnf("network %v is locked by %v, waiting up to %v", network.Name, locked.holder(), timeout)
+		}
+		if !sup.interrupts.sleep(lockRetryInterval) {
+			return nil, ErrInterrupted
+		}
+	}
+}
+
+// lockFile creates the lock file, recording the owner, unless it exists.
+// If it does, the holder it records is returned.
+func lockFile(file, owner string) (release func() error, holder string, err error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		return nil, strings.TrimSpace(string(data)), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = fmt.Fprintln(f, owner)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+		return nil, "", err
+	}
+	return func() error {
+		return os.Remove(file)
+	}, "", nil
+}
+
+// lockCommand runs the lock's command, with the env vars and the owner as
+// $SUP_LOCK_OWNER added to sup's environment. Its exiting non-zero means
+// the lock is held by the holder it printed.
+func lockCommand(network *Network, vars EnvList, owner string) (release func() error, holder string, err error) {
+	run := func(script string) ([]byte, error) {
+		cmd := shellCommand(network.LocalShell, "/bin/sh", script)
+		cmd.Env = append(append(os.Environ(), vars.Slice()...), "SUP_LOCK_OWNER="+owner)
+		return cmd.CombinedOutput()
+	}
+	out, err := run(network.Lock.Command)
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil, strings.TrimSpace(string(out)), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return func() error {
+		if network.Lock.Release == "" {
+			return nil
+		}
+		if out, err := run(network.Lock.Release); err != nil {
+			return errors.Wrapf(err, "release %q failed: %v", network.Lock.Release, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}, "", nil
+}
@@ -0,0 +1,143 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of sup's messages.
+type Level int
+
+const (
+	LevelInfo Level = iota
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel parses level of the name, ie. "warn".
+func ParseLevel(name string) (Level, error) {
+	for _, l := range []Level{LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q: expected info, warn or error", name)
+}
+
+// DefaultLogger writes messages of loading Supfiles, ie. deprecation warnings.
+var DefaultLogger = NewLogger(os.Stderr)
+
+// Logger writes sup's messages, as opposed to the commands' output.
+// By default, the messages are plain lines, warnings prefixed by "Warning: ".
+// With timestamps, every line is prefixed by its time and level instead,
+// ie. "2006-01-02T15:04:05Z warn message", including the commands' output
+// lines, STDOUT as info and STDERR as warn.
+type Logger struct {
+	w          io.Writer
+	level      Level
+	timestamps bool
+	mu         sync.Mutex
+}
+
+// NewLogger returns logger writing all the messages to w, without timestamps.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Timestamps enables timestamps and levels of the lines.
+func (l *Logger) Timestamps(value bool) {
+	l.timestamps = value
+}
+
+// Verbosity sets the least severe level of the messages written.
+func (l *Logger) Verbosity(level Level) {
+	l.level = level
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, "", format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, "", format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, "", format, args...)
+}
+
+// logf writes the message of the level, preceded by the host's prefix, if any.
+func (l *Logger) logf(level Level, prefix string, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	if level == LevelWarn && !l.timestamps {
+		msg = "Warning: " + msg
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.Split(msg, "\n") {
+		buf.WriteString(l.stamp(level) + prefix + line + "\n")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// stamp returns the time and level prefixing lines of the level, if enabled.
+func (l *Logger) stamp(level Level) string {
+	if !l.timestamps {
+		return ""
+	}
+	return time.Now().UTC().Format(time.RFC3339) + " " + level.String() + " "
+}
+
+// lines returns writer prefixing lines written to w by their time and
+// the level, if timestamps are enabled.
+func (l *Logger) lines(w io.Writer, level Level) io.Writer {
+	if !l.timestamps {
+		return w
+	}
+	return &stampWriter{log: l, w: w, level: level, start: true}
+}
+
+// stampWriter prefixes lines written to w by their time and level.
+type stampWriter struct {
+	log   *Logger
+	w     io.Writer
+	level Level
+	start bool // At the start of a line?
+}
+
+func (s *stampWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, b := range p {
+		if s.start {
+			buf.WriteString(s.log.stamp(s.level))
+		}
+		buf.WriteByte(b)
+		s.start = b == '\n'
+	}
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package sup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Versions of the Supfile format, oldest first.
+var supfileVersions = []string{"0.1", "0.2", "0.3", "0.4", "0.5"}
+
+var (
+	versionKeyRe  = regexp.MustCompile(`^version\s*:\s*["']?([^"'\s#]*)["']?`)
+	runOnceKeyRe  = regexp.MustCompile(`^(\s*)run_once(\s*:)`)
+	blockScalarRe = regexp.MustCompile(`:\s*[|>][-+0-9]*\s*(#.*)?$`)
+)
+
+// Migrate rewrites the Supfile, see ReadSupfile, to the toVersion of the
+// format and returns it: command.run_once, deprecated by command.once in
+// v0.3, is renamed and the version is bumped. The rest of the file, comments
+// included, is kept as it is, so migrating a Supfile of toVersion changes
+// nothing. Supfiles aren't migrated to older versions.
+func Migrate(file string, toVersion string) ([]byte, error) {
+	data, err := ReadSupfile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		Version  string `yaml:"version"`
+		Commands map[string]struct {
+			Once    bool `yaml:"once"`
+			RunOnce bool `yaml:"run_once"`
+		} `yaml:"commands"`
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, yamlError(err, file)
+	}
+
+	from := conf.Version
+	if from == "" {
+		from = "0.1"
+	}
+	fromIndex, toIndex := versionIndex(from), versionIndex(toVersion)
+	switch {
+	case fromIndex < 0:
+		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + from}
+	case toIndex < 0:
+		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + toVersion}
+	case toIndex < fromIndex:
+		return nil, errConfig{fmt.Errorf("can't migrate Supfile version %v to older version %v", from, toVersion)}
+	}
+
+	renameRunOnce := toIndex >= versionIndex("0.3")
+	if renameRunOnce {
+		var names []string
+		for name := range conf.Commands {
+			names = append(names, name)
+		}
+		for _, name := range sortedNames(names) {
+			if cmd := conf.Commands[name]; cmd.Once && cmd.RunOnce {
+				return nil, errConfig{fmt.Errorf("command %v: both once and run_once are set, remove run_once", name)}
+			}
+		}
+	}
+
+	// Rewrite the keys line by line, skipping the content of block scalars,
+	// ie. of "run: |", which is more indented than their key.
+	lines := strings.SplitAfter(string(data), "\n")
+	versioned := false
+	block := -1
+	for i, line := range lines {
+		content := strings.TrimRight(line, "\r\n")
+		indent := len(content) - len(strings.TrimLeft(content, " "))
+		if block >= 0 {
+			if strings.TrimSpace(content) == "" || indent > block {
+				continue
+			}
+			block = -1
+		}
+		if m := versionKeyRe.FindStringSubmatchIndex(line); m != nil {
+			line = line[:m[2]] + toVersion + line[m[3]:]
+			versioned = true
+		}
+		if renameRunOnce {
+			line = runOnceKeyRe.ReplaceAllString(line, "${1}once${2}")
+		}
+		if blockScalarRe.MatchString(content) {
+			block = indent
+		}
+		lines[i] = line
+	}
+	migrated := strings.Join(lines, "")
+	if !versioned {
+		migrated = "version: " + toVersion + "\n" + migrated
+	}
+
+	if err := yaml.Unmarshal([]byte(migrated), &yaml.MapSlice{}); err != nil {
+		return nil, errors.Wrap(yamlError(err, file), "migrating Supfile failed")
+	}
+	return []byte(migrated), nil
+}
+
+// versionIndex returns the index of the version in supfileVersions, or -1.
+func versionIndex(version string) int {
+	for i, v := range supfileVersions {
+		if v == version {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,90 @@
+package sup
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		in, to string
+		want   string
+		err    string
+	}{
+		{
+			in:   "version: 0.4\ncommands:\n  a:\n    run: echo\n    run_once: true # first host\n",
+			to:   "0.5",
+			want: "version: 0.5\ncommands:\n  a:\n    run: echo\n    once: true # first host\n",
+		},
+		{
+			in:   "version: \"0.2\"\ncommands:\n  a:\n    run_once: true\n",
+			to:   "0.3",
+			want: "version: \"0.3\"\ncommands:\n  a:\n    once: true\n",
+		},
+		{
+			// run_once is supported by v0.2 still.
+			in:   "version: 0.1\ncommands:\n  a:\n    run_once: true\n",
+			to:   "0.2",
+			want: "version: 0.2\ncommands:\n  a:\n    run_once: true\n",
+		},
+		{
+			in:   "commands:\n  a:\n    run: echo\n",
+			to:   "0.5",
+			want: "version: 0.5\ncommands:\n  a:\n    run: echo\n",
+		},
+		{
+			// Block scalars are kept as they are.
+			in:   "version: 0.4\ncommands:\n  a:\n    run: |\n      run_once: true\n      version: 1\n    run_once: true\n",
+			to:   "0.5",
+			want: "version: 0.5\ncommands:\n  a:\n    run: |\n      run_once: true\n      version: 1\n    once: true\n",
+		},
+		{
+			in:   "version: 0.5\ncommands:\n  a:\n    once: true\n",
+			to:   "0.5",
+			want: "version: 0.5\ncommands:\n  a:\n    once: true\n",
+		},
+		{
+			in:  "version: 0.5\n",
+			to:  "0.4",
+			err: "can't migrate Supfile version 0.5 to older version 0.4",
+		},
+		{
+			in:  "version: 0.9\n",
+			to:  "0.5",
+			err: "unsupported Supfile version 0.9",
+		},
+		{
+			in:  "version: 0.4\n",
+			to:  "1.0",
+			err: "unsupported Supfile version 1.0",
+		},
+		{
+			in:  "version: 0.4\ncommands:\n  a:\n    once: true\n    run_once: true\n",
+			to:  "0.5",
+			err: "command a: both once and run_once are set, remove run_once",
+		},
+	}
+
+	file := filepath.Join(t.TempDir(), "Supfile")
+	for _, test := range tests {
+		if err := ioutil.WriteFile(file, []byte(test.in), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Migrate(file, test.to)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Migrate(%q, %v): got error %v, want %q", test.in, test.to, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Migrate(%q, %v): %v", test.in, test.to, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("Migrate(%q, %v): got %q, want %q", test.in, test.to, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// notifyTimeout limits how long posting the notification may take.
+const notifyTimeout = 10 * time.Second
+
+// Notify is the webhook the results of every run are posted to, as JSON,
+// ie. a Slack or Teams incoming webhook. $VARS of the URL and the headers
+// are expanded from sup's environment, to keep tokens out of Supfiles.
+type Notify struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// notification is the JSON posted to the webhook. Text summarizes it
+// in a line, as displayed by Slack and Teams.
+type notification struct {
+	Text     string            `json:"text"`
+	Networks []string          `json:"networks"`
+	Commands []notifiedCommand `json:"commands"`
+	OK       int               `json:"ok"`     // Number of commands that succeeded on all their hosts.
+	Failed   int               `json:"failed"` // Number of commands that failed on some hosts.
+	Success  bool              `json:"success"`
+	Error    string            `json:"error,omitempty"`
+	Duration float64           `json:"duration"` // In seconds.
+}
+
+// notifiedCommand summarizes results of a command of the run.
+type notifiedCommand struct {
+	Command     string   `json:"command"`
+	OK          int      `json:"ok"`     // Number of hosts.
+	Failed      int      `json:"failed"` // Number of hosts.
+	FailedHosts []string `json:"failed_hosts,omitempty"`
+	Skipped     bool     `json:"skipped,omitempty"`
+	Duration    float64  `json:"duration"` // In seconds.
+
+	SkippedHosts int `json:"skipped_hosts,omitempty"` // Number of hosts skipped by skip_if.
+}
+
+// newNotification summarizes the run of the networks, started at start
+// and finished with err.
+func newNotification(networks []*Network, summary []commandSummary, start time.Time, err error) notification {
+	duration := time.Since(start)
+	n := notification{
+		Success:  err == nil,
+		Duration: duration.Seconds(),
+	}
+	for _, network := range networks {
+		n.Networks = append(n.Networks, network.Name)
+	}
+	for _, s := range summary {
+		n.Commands = append(n.Commands, notifiedCommand{
+			Command:     s.cmd,
+			OK:          s.ok,
+			Failed:      len(s.failed),
+			FailedHosts: s.failed,
+			Skipped:     s.skipped,
+			Duration:    s.duration.Seconds(),
+
+			SkippedHosts: s.skippedHosts,
+		})
+		switch {
+		case len(s.failed) > 0:
+			n.Failed++
+		case !s.skipped:
+			n.OK++
+		}
+	}
+
+	status := "succeeded"
+	if err != nil {
+		n.Error = err.Error()
+		status = "failed"
+	}
+	n.Text = fmt.Sprintf("sup %v on %v: %v ok, %v failed (%v)", status, strings.Join(n.Networks, ", "), n.OK, n.Failed, duration.Round(time.Second))
+	return n
+}
+
+// post posts the notification to the webhook. Any status but 2xx is
+// an error.
+func (notify *Notify) post(n notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", os.ExpandEnv(notify.URL), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range notify.Headers {
+		req.Header.Set(key, os.ExpandEnv(value))
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		if e, ok := err.(*url.Error); ok {
+			return e.Err // Webhook URLs are secrets, ie. Slack's.
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook responded %v", resp.Status)
+	}
+	return nil
+}
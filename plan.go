@@ -0,0 +1,166 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// printPlan prints commands to be run on the network and the hosts each
+// of them targets to w, without connecting to the hosts.
+func (sup *Stackup) printPlan(w io.Writer, network *Network, envVars EnvList, commands []*Command) error {
+	env := envVars.AsExport()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return errors.Wrap(err, "resolving CWD failed")
+	}
+
+	fmt.Fprintf(w, "Network %v:\n", network.Name)
+	for _, cmd := range commands {
+		cmd = network.withDefaults(cmd)
+		envVars := cmd.envVars(envVars)
+		if cmd.When != "" {
+			ok, err := evalCondition(cmd.When, envVars)
+			if err != nil {
+				return errors.Wrap(err, cmd.Name)
+			}
+			if !ok {
+				fmt.Fprintf(w, "- %v: skipped, condition %q is false\n", cmd.Name, cmd.When)
+				continue
+			}
+		}
+
+		hosts := network.Hosts
+		if cmd.Once {
+			hosts = hosts[:1]
+		}
+		if cmd.OncePer != "" {
+			hosts = network.oncePer(hosts, cmd.OncePer, envVars)
+		}
+
+		fmt.Fprintf(w, "- %v:\n", cmd.Name)
+		if cmd.OncePer != "" {
+			fmt.Fprintf(w, "    hosts (once per %v): %v\n", cmd.OncePer, strings.Join(hosts, ", "))
+		} else if batch := cmd.batch(sup.maxParallel); batch > 0 && (cmd.Serial > 0 || batch < len(hosts)) && !cmd.Once {
+			fmt.Fprintf(w, "    hosts (%v at a time): %v\n", batch, strings.Join(hosts, ", "))
+		} else {
+			fmt.Fprintf(w, "    hosts: %v\n", strings.Join(hosts, ", "))
+		}
+		if cmd.Dir != "" {
+			fmt.Fprintf(w, "    dir: %v\n", cmd.Dir)
+		}
+		if len(cmd.Env) > 0 {
+			names := make([]string, len(cmd.Env))
+			for i, v := range cmd.Env {
+				names[i] = v.Key
+			}
+			fmt.Fprintf(w, "    env: %v\n", strings.Join(names, ", "))
+		}
+		if cmd.SkipIf != "" {
+			fmt.Fprintf(w, "    skip if: %v\n", cmd.SkipIf)
+		}
+		if cmd.forwardsAgent() {
+			fmt.Fprintf(w, "    ssh agent: forwarded\n")
+		}
+		if cmd.Changed != "" {
+			fmt.Fprintf(w, "    changed: %v\n", cmd.Changed)
+		}
+		if sudo := cmd.sudo(sup.sudoPass != ""); sudo != "" {
+			fmt.Fprintf(w, "    via: %v\n", sudo)
+		}
+		if cmd.Shell != "" && (cmd.Run != "" || cmd.Script != "") {
+			fmt.Fprintf(w, "    shell: %v\n", cmd.Shell)
+		}
+		if cmd.LocalShell != "" && cmd.Local != "" {
+			fmt.Fprintf(w, "    local shell: %v\n", cmd.LocalShell)
+		}
+		for _, upload := range cmd.Upload {
+			if upload.When != "" {
+				ok, err := evalCondition(upload.When, envVars)
+				if err != nil {
+					return errors.Wrap(err, "upload: "+upload.name())
+				}
+				if !ok {
+					fmt.Fprintf(w, "    upload: %v skipped, condition %q is false\n", upload.name(), upload.When)
+					continue
+				}
+			}
+			paths, err := upload.paths(cwd, env+cmd.Env.AsExport())
+			if err != nil {
+				return errors.Wrap(err, "upload: "+upload.name())
+			}
+			if len(paths) == 0 {
+				fmt.Fprintf(w, "    upload: %v skipped, no paths match\n", upload.name())
+				continue
+			}
+			for _, path := range paths {
+				if _, err := os.Stat(path); err != nil {
+					return errors.Wrap(err, "upload: "+upload.name())
+				}
+			}
+			dst, err := expandVars(upload.Dst, envVars)
+			if err != nil {
+				return errors.Wrap(err, "upload: "+upload.Dst)
+			}
+			var attrs []string
+			if upload.Mode != "" {
+				attrs = append(attrs, "mode "+upload.Mode)
+			}
+			if upload.Owner != "" {
+				attrs = append(attrs, "owner "+upload.Owner)
+			}
+			if upload.Verify {
+				attrs = append(attrs, "verified")
+			}
+			if upload.Incremental {
+				attrs = append(attrs, "incremental")
+			}
+			if pool := cmd.uploadPool(len(hosts)); pool != nil {
+				attrs = append(attrs, fmt.Sprintf("%v hosts at a time", pool.size))
+			}
+			if len(attrs) > 0 {
+				dst += " (" + strings.Join(attrs, ", ") + ")"
+			}
+			fmt.Fprintf(w, "    upload: %v -> %v\n", strings.Join(paths, ", "), dst)
+		}
+		if cmd.Script != "" {
+			data, err := ioutil.ReadFile(cmd.Script)
+			if err != nil {
+				return errors.Wrap(err, "can't read script")
+			}
+			fmt.Fprintf(w, "    script: %v %v\n%v", cmd.Script, cmd.Args, indent(string(data), "      "))
+		}
+		if cmd.Local != "" {
+			if cmd.CaptureEnv != "" {
+				fmt.Fprintf(w, "    local (localhost, STDOUT to $%v):\n%v", cmd.CaptureEnv, indent(cmd.Local, "      "))
+			} else if cmd.LocalPerHost {
+				fmt.Fprintf(w, "    local (localhost, once per host):\n%v", indent(cmd.Local, "      "))
+			} else {
+				fmt.Fprintf(w, "    local (localhost):\n%v", indent(cmd.Local, "      "))
+			}
+		}
+		if cmd.Run != "" {
+			fmt.Fprintf(w, "    run:\n%v", indent(cmd.Run, "      "))
+		}
+		for _, download := range cmd.Download {
+			src, err := expandVars(download.Src, envVars)
+			if err != nil {
+				return errors.Wrap(err, "download: "+download.Src)
+			}
+			fmt.Fprintf(w, "    download: %v -> %v\n", src, download.Dst)
+		}
+	}
+
+	return nil
+}
+
+// indent prefixes every line of s, ending s with a new line.
+func indent(s, prefix string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return prefix + strings.Join(lines, "\n"+prefix) + "\n"
+}
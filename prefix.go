@@ -0,0 +1,52 @@
+package sup
+
+import (
+	"bytes"
+	"hash/fnv"
+	"text/template"
+)
+
+// DefaultPrefixTemplate renders the default output prefix, ie. "user@host:22 | ".
+const DefaultPrefixTemplate = "{{.User}}@{{.Addr}} | "
+
+// prefixData is available to the prefix template.
+type prefixData struct {
+	Host string // Host name, ie. "api1.example.com".
+	Addr string // Host and port, ie. "api1.example.com:22", or "localhost".
+	User string // Remote user.
+}
+
+func clientPrefixData(c Client) prefixData {
+	switch c := c.(type) {
+	case *SSHClient:
+		return prefixData{Host: c.Host(), Addr: c.host, User: c.user}
+	case *LocalhostClient:
+		if c.target != nil {
+			target := clientPrefixData(c.target)
+			return prefixData{Host: target.Host, Addr: "localhost > " + target.Addr, User: c.user}
+		}
+		return prefixData{Host: c.Host(), Addr: c.Host(), User: c.user}
+	}
+	return prefixData{Host: c.Host(), Addr: c.Host()}
+}
+
+// prefixText renders the client's output prefix, without colors.
+func (sup *Stackup) prefixText(c Client) string {
+	tmpl := sup.prefixTmpl
+	if tmpl == nil {
+		tmpl = defaultPrefixTmpl
+	}
+	var buf bytes.Buffer
+	tmpl.Execute(&buf, clientPrefixData(c)) // Checked by PrefixTemplate.
+	return buf.String()
+}
+
+var defaultPrefixTmpl = template.Must(template.New("prefix").Parse(DefaultPrefixTemplate))
+
+// hostColor returns the color of the host; it's the same for the host
+// in every run.
+func hostColor(host string) string {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return Colors[h.Sum32()%uint32(len(Colors))]
+}
@@ -0,0 +1,120 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// preflightCheck checks the network's hosts are reachable, optionally
+// through the bastion, before running anything on them. Unreachable hosts
+// are an error, unless the network continues on error; then they're skipped
+// with a warning.
+func (sup *Stackup) preflightCheck(network *Network, bastion *SSHClient) (*Network, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	unreachable := make(map[string]error)
+
+	for _, host := range network.Hosts {
+		if host == "localhost" {
+			continue
+		}
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := sup.reach(host, network, bastion); err != nil {
+				mu.Lock()
+				unreachable[host] = err
+				mu.Unlock()
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	if len(unreachable) == 0 {
+		return network, nil
+	}
+
+	var reachable, lines []string
+	for _, host := range network.Hosts {
+		if err, ok := unreachable[host]; ok {
+			lines = append(lines, fmt.Sprintf("- %v: %v", host, err))
+		} else {
+			reachable = append(reachable, host)
+		}
+	}
+	sort.Strings(lines)
+	report := fmt.Sprintf("%v unreachable host(s):\n%v", len(unreachable), strings.Join(lines, "\n"))
+
+	if !network.ContinueOnError || len(reachable) == 0 {
+		return nil, ErrUnreachable{report}
+	}
+	sup.log.Warnf("preflight skipping %v", report)
+	checked := *network
+	checked.Hosts = reachable
+	return &checked, nil
+}
+
+// ErrUnreachable is returned when hosts fail the preflight check.
+type ErrUnreachable struct {
+	Report string // Number of the unreachable hosts and why, one per line.
+}
+
+func (e ErrUnreachable) Error() string {
+	return "preflight failed, " + e.Report
+}
+
+func (e ErrUnreachable) ExitCode() int {
+	return ExitConnect
+}
+
+// reach connects to the host's SSH port and reads the server's SSH
+// identification within the preflight timeout.
+func (sup *Stackup) reach(host string, network *Network, bastion *SSHClient) error {
+	c := &SSHClient{port: network.Port}
+	if err := c.parseHost(host); err != nil {
+		return err
+	}
+
+	// Connections through the bastion can't time out by themselves.
+	errCh := make(chan error, 1)
+	go func() {
+		var conn net.Conn
+		var err error
+		if bastion != nil {
+			conn, err = bastion.conn.Dial("tcp", c.host)
+		} else {
+			conn, err = net.DialTimeout("tcp", c.host, sup.preflight)
+		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(sup.preflight)) // Unsupported through the bastion.
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			errCh <- errors.Wrap(err, "reading SSH identification failed")
+			return
+		}
+		if !strings.HasPrefix(line, "SSH-") {
+			errCh <- fmt.Errorf("not an SSH server: %q", strings.TrimSpace(line))
+			return
+		}
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(sup.preflight):
+		return fmt.Errorf("timed out after %v", sup.preflight)
+	}
+}
@@ -0,0 +1,74 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateUnits are the multipliers of the upload limit's suffixes, ie. "10M".
+var rateUnits = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+}
+
+// ParseRate parses the bytes per second of the rate, ie. "512K" or "10M",
+// optionally suffixed by "/s". Zero means unlimited.
+func ParseRate(rate string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(rate)), "/S")
+	s = strings.TrimSuffix(s, "B")
+	unit := int64(1)
+	if s != "" {
+		if u, ok := rateUnits[s[len(s)-1]]; ok {
+			unit, s = u, s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q: expected bytes per second, ie. 512K or 10M", rate)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// limitUpload returns reader of the upload's tar stream r, sent to hosts
+// clients, throttled to the upload limit, if any.
+func (sup *Stackup) limitUpload(r io.Reader, hosts int) io.Reader {
+	if sup.uploadLimit <= 0 || hosts == 0 {
+		return r
+	}
+	return &limitedReader{r: r, rate: sup.uploadLimit, hosts: int64(hosts)}
+}
+
+// limitedReader reads a stream sent to multiple hosts at once, so that
+// the total bytes sent to all of them don't exceed the rate per second.
+type limitedReader struct {
+	r     io.Reader
+	rate  int64 // Bytes per second.
+	hosts int64
+	start time.Time // Of the first read.
+	sent  int64     // Bytes sent to all the hosts so far.
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	// Read up to a tenth of a second's worth, so the stream flows evenly.
+	max := l.rate / 10 / l.hosts
+	if max < 1 {
+		max = 1
+	}
+	if int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	l.sent += int64(n) * l.hosts
+	due := time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second))
+	if wait := due - time.Since(l.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
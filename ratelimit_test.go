@@ -0,0 +1,43 @@
+package sup
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want int64
+		err  bool
+	}{
+		{rate: "0", want: 0},
+		{rate: "100", want: 100},
+		{rate: "512K", want: 512 << 10},
+		{rate: "512k", want: 512 << 10},
+		{rate: "10M", want: 10 << 20},
+		{rate: "10MB", want: 10 << 20},
+		{rate: "10M/s", want: 10 << 20},
+		{rate: " 10mb/s ", want: 10 << 20},
+		{rate: "1.5M", want: 3 << 19},
+		{rate: "1G", want: 1 << 30},
+		{rate: "", err: true},
+		{rate: "M", err: true},
+		{rate: "-1M", err: true},
+		{rate: "10T", err: true},
+		{rate: "fast", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseRate(test.rate)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseRate(%q): got %v, want error", test.rate, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRate(%q): %v", test.rate, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseRate(%q): got %v, want %v", test.rate, got, test.want)
+		}
+	}
+}
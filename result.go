@@ -0,0 +1,215 @@
+package sup
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxResultOutput is the max number of bytes of STDOUT and STDERR kept
+// in a Result. Longer output is truncated to its last bytes.
+const maxResultOutput = 4096
+
+// Result represents a command run on a host, written as JSON by Stackup
+// in JSON mode.
+type Result struct {
+	Host     string  `json:"host"`
+	Command  string  `json:"command"`
+	ExitCode int     `json:"exit_code"` // -1 if the command didn't exit with a status.
+	Duration float64 `json:"duration"`  // In seconds.
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+	Error    string  `json:"error,omitempty"`
+	Changed  *bool   `json:"changed,omitempty"` // Set if the command has a changed check.
+	Skipped  bool    `json:"skipped,omitempty"` // Whether the skip_if guard of the command passed.
+}
+
+// commandSummary summarizes results of a command on its clients.
+type commandSummary struct {
+	cmd      string
+	ok       int
+	failed   []string // Hosts the command failed on.
+	changed  int      // Number of ok hosts changed by the command, if checked.
+	checked  bool
+	duration time.Duration
+	skipped  bool
+
+	skippedHosts int // Number of hosts the command was skipped on by skip_if.
+
+	// Ok hosts no output line of matched the pattern of Grep, if set.
+	grepped   bool
+	unmatched []string
+}
+
+// results collects results of a command on its clients.
+type results struct {
+	cmd      string
+	start    time.Time
+	list     []*result
+	byClient map[Client]*result
+	grepped  bool // Is the output grepped? See Stackup.Grep.
+	mu       sync.Mutex
+}
+
+type result struct {
+	Result
+	start  time.Time
+	stdout tailBuffer
+	stderr tailBuffer
+
+	matches int // Number of output lines matching the pattern of Grep.
+}
+
+func newResults(cmd string) *results {
+	return &results{
+		cmd:      cmd,
+		start:    time.Now(),
+		byClient: make(map[Client]*result),
+	}
+}
+
+// of returns the client's result, starting it on the first call.
+func (r *results) of(c Client) *result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res, ok := r.byClient[c]
+	if !ok {
+		res = &result{
+			Result: Result{Host: c.Host(), Command: r.cmd},
+			start:  time.Now(),
+		}
+		r.byClient[c] = res
+		r.list = append(r.list, res)
+	}
+	return res
+}
+
+// done records the client finishing a task with err.
+func (r *results) done(c Client, err error) {
+	res := r.of(c)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res.Duration = time.Since(res.start).Seconds()
+	if err != nil {
+		res.ExitCode = exitCode(err)
+		res.Error = err.Error()
+	}
+}
+
+// matched records a line of the client's output matched the pattern of Grep.
+func (r *results) matched(c Client) {
+	res := r.of(c)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res.matches++
+}
+
+// summary summarizes the results so far.
+func (r *results) summary() commandSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := commandSummary{
+		cmd:      r.cmd,
+		duration: time.Since(r.start).Round(time.Millisecond),
+		grepped:  r.grepped,
+	}
+	for _, res := range r.list {
+		if res.Error != "" {
+			s.failed = append(s.failed, res.Host)
+			continue
+		}
+		if res.Skipped {
+			s.skippedHosts++
+			continue
+		}
+		s.ok++
+		if r.grepped && res.matches == 0 {
+			s.unmatched = append(s.unmatched, res.Host)
+		}
+		if res.Changed != nil {
+			s.checked = true
+			if *res.Changed {
+				s.changed++
+			}
+		}
+	}
+	return s
+}
+
+// checked records whether the clients were changed by the command.
+func (r *results) checked(check *changeCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c, res := range r.byClient {
+		if changed, ok := check.changed(c); ok {
+			res.Changed = &changed
+		}
+	}
+}
+
+// skipped records the clients the command was skipped on by the guard.
+func (r *results) skipped(check *skipCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c, res := range r.byClient {
+		if check.passed(c) {
+			res.Skipped = true
+		}
+	}
+}
+
+// write writes the results to w as newline-delimited JSON.
+func (r *results) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	enc := json.NewEncoder(w)
+	for _, res := range r.list {
+		res.Stdout = res.stdout.String()
+		res.Stderr = res.stderr.String()
+		if err := enc.Encode(res.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitCode returns exit status of the failed command, or -1
+// if it didn't exit with a status.
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case *ssh.ExitError:
+		return err.ExitStatus()
+	case *exec.ExitError:
+		if status, ok := err.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// tailBuffer keeps the last maxResultOutput bytes written to it.
+type tailBuffer struct {
+	buf []byte
+	mu  sync.Mutex
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxResultOutput {
+		b.buf = append([]byte{}, b.buf[len(b.buf)-maxResultOutput:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
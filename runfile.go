@@ -0,0 +1,45 @@
+package sup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadRunFiles sets run of the commands to the content of their run_file.
+// Relative paths are resolved against dir.
+func (conf *Supfile) loadRunFiles(dir string) error {
+	for _, name := range conf.Commands.Names {
+		cmd := conf.Commands.cmds[name]
+		if cmd.RunFile == "" {
+			continue
+		}
+		if cmd.hasRun() {
+			return errConfig{fmt.Errorf("command %v: run and run_file can't both be set", name)}
+		}
+		file := cmd.RunFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errConfig{errors.Wrapf(err, "command %v: reading run_file failed", name)}
+		}
+		cmd.Run = string(data)
+		conf.Commands.cmds[name] = cmd
+	}
+	return nil
+}
+
+// supfileDir returns the directory of the Supfile of the name, paths of the
+// Supfile are relative to. Supfiles read from STDIN or a URL have none; their
+// paths are relative to the working directory.
+func supfileDir(name string) string {
+	if name == "stdin" || name == "-" || strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return ""
+	}
+	return filepath.Dir(name)
+}
@@ -0,0 +1,57 @@
+package sup
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secretPrefix marks env values resolved from STDOUT of a local command,
+// ie. "!cmd: vault read -field=password secret/app".
+const secretPrefix = "!cmd:"
+
+// isSecret reports whether the env value is resolved by a command.
+func isSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+// resolveSecrets runs the commands of the Supfile's and networks' env values
+// marked by secretPrefix and substitutes the values by their trimmed STDOUT.
+func (conf *Supfile) resolveSecrets() error {
+	if err := resolveSecretEnv(conf.Env); err != nil {
+		return err
+	}
+	for _, name := range conf.Networks.Names {
+		if err := resolveSecretEnv(conf.Networks.nets[name].Env); err != nil {
+			return errors.Wrapf(err, "network %v", name)
+		}
+	}
+	return nil
+}
+
+// resolveSecretEnv resolves the secret values of env in place. The values
+// are never part of the errors; the commands' STDERR is passed through.
+func resolveSecretEnv(env EnvList) error {
+	for _, v := range env {
+		if !isSecret(v.Value) {
+			continue
+		}
+		cmd := exec.Command("bash", "-c", strings.TrimSpace(strings.TrimPrefix(v.Value, secretPrefix)))
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return errors.Wrapf(err, "resolving secret env var %v failed", v.Key)
+		}
+		v.Value = secretValue(strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// secretValue quotes the secret so it's taken literally by ResolveValues,
+// which echoes the values, and by the commands' "export KEY="value";".
+func secretValue(secret string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(secret)
+	return "'" + strings.Replace(escaped, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,68 @@
+package sup
+
+import (
+	"io"
+	"sync"
+)
+
+// skipCheck records the clients the command's skip_if guard passed on,
+// ie. already converged; the rest of the command is skipped on them.
+type skipCheck struct {
+	skipped map[Client]bool
+	mu      sync.Mutex
+}
+
+func newSkipCheck() *skipCheck {
+	return &skipCheck{skipped: make(map[Client]bool)}
+}
+
+// task returns the task running the guard. Its STDOUT is discarded.
+func (check *skipCheck) task(run string) Task {
+	return Task{
+		Run: run,
+		Output: func(c Client) (io.WriteCloser, error) {
+			return discardOutput{}, nil
+		},
+		skip: check,
+	}
+}
+
+// record records the guard exiting with err on the client, which is
+// skipped if the guard passed. Exiting non-zero isn't the guard's failure;
+// the command is run on the client. Other errors, ie. timeouts, are.
+func (check *skipCheck) record(c Client, err error) error {
+	if err != nil {
+		if exitCode(err) > 0 {
+			return nil
+		}
+		return err
+	}
+	check.mu.Lock()
+	defer check.mu.Unlock()
+	check.skipped[c] = true
+	return nil
+}
+
+// passed reports whether the guard passed on the client.
+func (check *skipCheck) passed(c Client) bool {
+	check.mu.Lock()
+	defer check.mu.Unlock()
+	return check.skipped[c]
+}
+
+// without returns the clients the command isn't skipped on.
+func (check *skipCheck) without(clients []Client) []Client {
+	var left []Client
+	for _, c := range clients {
+		if !check.passed(c) {
+			left = append(left, c)
+		}
+	}
+	return left
+}
+
+// discardOutput discards the output written to it.
+type discardOutput struct{}
+
+func (discardOutput) Write(p []byte) (int, error) { return len(p), nil }
+func (discardOutput) Close() error                { return nil }
@@ -8,8 +8,10 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -21,6 +23,9 @@ type SSHClient struct {
 	sess         *ssh.Session
 	user         string
 	host         string
+	port         int      // Port of the host not specifying one, 22 by default.
+	identityFile string   // Private key to authenticate with, besides the default ones.
+	sshOptions   []string // See Network.SSHOptions.
 	remoteStdin  io.WriteCloser
 	remoteStdout io.Reader
 	remoteStderr io.Reader
@@ -28,7 +33,12 @@ type SSHClient struct {
 	sessOpened   bool
 	running      bool
 	env          string //export FOO="bar"; export BAR="baz";
-	color        string
+
+	timeout      time.Duration // Connect timeout, if any, overridden by ConnectTimeout of sshOptions.
+	keepalive    time.Duration // Interval of keepalives, if any.
+	keepaliveEnd chan struct{} // Closed to stop the keepalives.
+
+	agentForwarded bool // Are the connection's agent channels forwarded to the local agent?
 }
 
 type ErrConnect struct {
@@ -41,6 +51,10 @@ func (e ErrConnect) Error() string {
 	return fmt.Sprintf(`Connect("%v@%v"): %v`, e.User, e.Host, e.Reason)
 }
 
+func (e ErrConnect) ExitCode() int {
+	return ExitConnect
+}
+
 // parseHost parses and normalizes <user>@<host:port> from a given string.
 func (c *SSHClient) parseHost(host string) error {
 	c.host = host
@@ -70,7 +84,11 @@ func (c *SSHClient) parseHost(host string) error {
 
 	// Add default port, if not set
 	if strings.Index(c.host, ":") == -1 {
-		c.host += ":22"
+		port := c.port
+		if port == 0 {
+			port = 22
+		}
+		c.host += ":" + strconv.Itoa(port)
 	}
 
 	return nil
@@ -78,6 +96,7 @@ func (c *SSHClient) parseHost(host string) error {
 
 var initAuthMethodOnce sync.Once
 var authMethod ssh.AuthMethod
+var authSigners []ssh.Signer
 
 // initAuthMethod initiates SSH authentication method.
 func initAuthMethod() {
@@ -107,9 +126,27 @@ func initAuthMethod() {
 		signers = append(signers, signer)
 
 	}
+	authSigners = signers
 	authMethod = ssh.PublicKeys(signers...)
 }
 
+// identityAuthMethod returns SSH authentication method trying the private key
+// of the identity file first, then the default ones.
+func identityAuthMethod(file string) (ssh.AuthMethod, error) {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		file = os.Getenv("HOME") + file[1:]
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %v failed: %v", file, err)
+	}
+	return ssh.PublicKeys(append([]ssh.Signer{signer}, authSigners...)...), nil
+}
+
 // SSHDialFunc can dial an ssh server and return a client
 type SSHDialFunc func(net, addr string, config *ssh.ClientConfig) (*ssh.Client, error)
 
@@ -134,18 +171,34 @@ func (c *SSHClient) ConnectWith(host string, dialer SSHDialFunc) error {
 		return err
 	}
 
+	auth := authMethod
+	if c.identityFile != "" {
+		auth, err = identityAuthMethod(c.identityFile)
+		if err != nil {
+			return ErrConnect{c.user, c.host, err.Error()}
+		}
+	}
+
 	config := &ssh.ClientConfig{
 		User: c.user,
 		Auth: []ssh.AuthMethod{
-			authMethod,
+			auth,
 		},
+		Timeout: c.timeout,
+	}
+	if err := applySSHOptions(config, c.sshOptions); err != nil {
+		return ErrConnect{c.user, c.host, err.Error()}
 	}
 
-	c.conn, err = dialer("tcp", c.host, config)
+	c.conn, err = dialTimeout(dialer, c.host, config)
 	if err != nil {
 		return ErrConnect{c.user, c.host, err.Error()}
 	}
 	c.connOpened = true
+	if c.keepalive > 0 {
+		c.keepaliveEnd = make(chan struct{})
+		go keepAlive(c.conn, c.keepalive, c.keepaliveEnd)
+	}
 
 	return nil
 }
@@ -179,6 +232,13 @@ func (c *SSHClient) Run(task *Task) error {
 		return err
 	}
 
+	// Forward the local SSH agent, if there's one running.
+	if task.forwardAgent && c.forwardAgent() {
+		if err := agent.RequestAgentForwarding(sess); err != nil {
+			return ErrTask{task, fmt.Sprintf("request for agent forwarding failed: %s", err)}
+		}
+	}
+
 	if task.TTY {
 		// Set up terminal modes
 		modes := ssh.TerminalModes{
@@ -193,7 +253,7 @@ func (c *SSHClient) Run(task *Task) error {
 	}
 
 	// Start the remote command.
-	if err := sess.Start(c.env + task.Run); err != nil {
+	if err := sess.Start(task.command(c, c.env)); err != nil {
 		return ErrTask{task, err.Error()}
 	}
 
@@ -203,6 +263,25 @@ func (c *SSHClient) Run(task *Task) error {
 	return nil
 }
 
+// forwardAgent routes the connection's agent channels to the local SSH agent,
+// once. It reports whether they are, ie. false if there's no agent running.
+func (c *SSHClient) forwardAgent() bool {
+	if !c.agentForwarded {
+		c.agentForwarded = agent.ForwardToRemote(c.conn, os.Getenv("SSH_AUTH_SOCK")) == nil
+	}
+	return c.agentForwarded
+}
+
+// agentRunning reports whether there's a local SSH agent to forward.
+func agentRunning() bool {
+	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return false
+	}
+	sock.Close()
+	return true
+}
+
 // Wait waits until the remote command finishes and exits.
 // It closes the SSH session.
 func (c *SSHClient) Wait() error {
@@ -241,6 +320,10 @@ func (c *SSHClient) Close() error {
 	if !c.connOpened {
 		return fmt.Errorf("Trying to close the already closed connection")
 	}
+	if c.keepaliveEnd != nil {
+		close(c.keepaliveEnd)
+		c.keepaliveEnd = nil
+	}
 
 	err := c.conn.Close()
 	c.connOpened = false
@@ -263,7 +346,16 @@ func (c *SSHClient) Stdout() io.Reader {
 
 func (c *SSHClient) Prefix() (string, int) {
 	host := c.user + "@" + c.host + " | "
-	return c.color + host + ResetColor, len(host)
+	return hostColor(c.Host()) + host + ResetColor, len(host)
+}
+
+// Host returns the remote host name, without the user and port.
+func (c *SSHClient) Host() string {
+	host, _, err := net.SplitHostPort(c.host)
+	if err != nil {
+		return c.host
+	}
+	return host
 }
 
 func (c *SSHClient) Write(p []byte) (n int, err error) {
@@ -288,6 +380,11 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 		// https://github.com/golang/go/issues/4115#issuecomment-66070418
 		c.remoteStdin.Write([]byte("\x03"))
 		return c.sess.Signal(ssh.SIGINT)
+	case os.Kill:
+		// Not every SSH server honors signals; closing the session
+		// hangs up the remote command anyway.
+		c.sess.Signal(ssh.SIGKILL)
+		return c.sess.Close()
 	default:
 		return fmt.Errorf("%v not supported", sig)
 	}
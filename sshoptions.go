@@ -0,0 +1,159 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshOptionNames are the supported ssh_options, as in ssh_config(5),
+// by their lowercase names.
+var sshOptionNames = map[string]string{
+	"connecttimeout":        "ConnectTimeout",
+	"stricthostkeychecking": "StrictHostKeyChecking",
+	"userknownhostsfile":    "UserKnownHostsFile",
+	"ciphers":               "Ciphers",
+	"kexalgorithms":         "KexAlgorithms",
+	"macs":                  "MACs",
+	"hostkeyalgorithms":     "HostKeyAlgorithms",
+}
+
+// parseSSHOption parses the option of the form "Name=value" or "Name value",
+// returning its canonical name.
+func parseSSHOption(option string) (name string, value string, err error) {
+	option = strings.TrimSpace(option)
+	i := strings.IndexAny(option, "= \t")
+	if i == -1 {
+		return "", "", fmt.Errorf("invalid ssh option %q: expected Name=value", option)
+	}
+	name, ok := sshOptionNames[strings.ToLower(option[:i])]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported ssh option %q: expected one of ConnectTimeout, StrictHostKeyChecking, UserKnownHostsFile, Ciphers, KexAlgorithms, MACs or HostKeyAlgorithms", option[:i])
+	}
+	value = strings.TrimSpace(strings.TrimLeft(option[i:], "= \t"))
+	if value == "" {
+		return "", "", fmt.Errorf("invalid ssh option %q: missing value", option)
+	}
+
+	switch name {
+	case "ConnectTimeout":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return "", "", fmt.Errorf("invalid ssh option %q: expected number of seconds", option)
+		}
+	case "StrictHostKeyChecking":
+		if value != "yes" && value != "no" {
+			return "", "", fmt.Errorf("invalid ssh option %q: expected yes or no", option)
+		}
+	}
+	return name, value, nil
+}
+
+// applySSHOptions configures the SSH connection by the options. Host keys are
+// checked against the known hosts files only if StrictHostKeyChecking is yes.
+func applySSHOptions(config *ssh.ClientConfig, options []string) error {
+	strict := false
+	knownHosts := []string{"~/.ssh/known_hosts"}
+	for _, option := range options {
+		name, value, err := parseSSHOption(option)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "ConnectTimeout":
+			n, _ := strconv.Atoi(value)
+			config.Timeout = time.Duration(n) * time.Second
+		case "StrictHostKeyChecking":
+			strict = value == "yes"
+		case "UserKnownHostsFile":
+			knownHosts = strings.Fields(value)
+		case "Ciphers":
+			config.Ciphers = strings.Split(value, ",")
+		case "KexAlgorithms":
+			config.KeyExchanges = strings.Split(value, ",")
+		case "MACs":
+			config.MACs = strings.Split(value, ",")
+		case "HostKeyAlgorithms":
+			config.HostKeyAlgorithms = strings.Split(value, ",")
+		}
+	}
+	if strict {
+		config.HostKeyCallback = knownHostsCallback(knownHosts)
+	}
+	return nil
+}
+
+// knownHostsCallback checks the host's key is listed by any of the known
+// hosts files, by plain or hashed host names.
+func knownHostsCallback(files []string) func(string, net.Addr, ssh.PublicKey) error {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host, port, err := net.SplitHostPort(hostname)
+		if err != nil {
+			host, port = hostname, "22"
+		}
+		name := host
+		if port != "22" {
+			name = "[" + host + "]:" + port
+		}
+
+		for _, file := range files {
+			if file == "~" || strings.HasPrefix(file, "~/") {
+				file = os.Getenv("HOME") + file[1:]
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				marker, hosts, pubKey, _, _, err := ssh.ParseKnownHosts(scanner.Bytes())
+				if err != nil || marker != "" { // Revoked keys and CAs aren't supported.
+					continue
+				}
+				if knownHost(hosts, name) && bytes.Equal(pubKey.Marshal(), key.Marshal()) {
+					f.Close()
+					return nil
+				}
+			}
+			f.Close()
+		}
+		return fmt.Errorf("host key of %v (%v) isn't known: StrictHostKeyChecking is yes", name, key.Type())
+	}
+}
+
+// knownHost reports whether the known hosts entry matches the host name,
+// ie. "example.com", "[example.com]:2222", "*.example.com" or a hashed one.
+func knownHost(hosts []string, name string) bool {
+	for _, host := range hosts {
+		if strings.HasPrefix(host, "|1|") {
+			parts := strings.Split(host[3:], "|")
+			if len(parts) != 2 {
+				continue
+			}
+			salt, err := base64.StdEncoding.DecodeString(parts[0])
+			if err != nil {
+				continue
+			}
+			mac := hmac.New(sha1.New, salt)
+			mac.Write([]byte(name))
+			if base64.StdEncoding.EncodeToString(mac.Sum(nil)) == parts[1] {
+				return true
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(host, name); ok {
+			return true
+		}
+	}
+	return false
+}
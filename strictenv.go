@@ -0,0 +1,214 @@
+package sup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// shellVars are set by the remote shell itself, not to be defined by env.
+var shellVars = map[string]bool{
+	"BASH_SOURCE": true, "BASHPID": true, "EUID": true, "HOME": true, "HOSTNAME": true,
+	"IFS": true, "LINENO": true, "OLDPWD": true, "OPTARG": true, "OPTIND": true,
+	"PATH": true, "PPID": true, "PWD": true, "RANDOM": true, "REPLY": true,
+	"SECONDS": true, "SHELL": true, "UID": true, "USER": true,
+}
+
+var (
+	assignedVarRe = regexp.MustCompile(`(?:^|[\s;&|(])([A-Za-z_][A-Za-z0-9_]*)=`)
+	forVarRe      = regexp.MustCompile(`\bfor\s+([A-Za-z_][A-Za-z0-9_]*)\s+in\b`)
+	readVarsRe    = regexp.MustCompile(`\bread\b([^;&|\n]*)`)
+)
+
+// assignedVars returns the names of vars the shell commands assign
+// themselves, ie. by "NAME=value", "for NAME in" or "read NAME".
+func assignedVars(s string) map[string]bool {
+	assigned := make(map[string]bool)
+	for _, m := range assignedVarRe.FindAllStringSubmatch(s, -1) {
+		assigned[m[1]] = true
+	}
+	for _, m := range forVarRe.FindAllStringSubmatch(s, -1) {
+		assigned[m[1]] = true
+	}
+	for _, m := range readVarsRe.FindAllStringSubmatch(s, -1) {
+		for _, name := range strings.Fields(m[1]) {
+			if isEnvName(name) {
+				assigned[name] = true
+			}
+		}
+	}
+	return assigned
+}
+
+// undefinedVars returns the names of env vars s references, in order,
+// which defined doesn't know and s doesn't assign itself.
+func undefinedVars(s string, defined func(name string) bool) []string {
+	assigned := assignedVars(s)
+	var undefined []string
+	seen := make(map[string]bool)
+	expandEnv(s, func(name string) (string, bool, error) {
+		if !defined(name) && !assigned[name] && !seen[name] {
+			seen[name] = true
+			undefined = append(undefined, name)
+		}
+		return "", false, nil
+	})
+	return undefined
+}
+
+// checkEnv returns errors of references to undefined env vars of the commands
+// run on the network, including its pre and post commands and the commands'
+// on_failure commands, see Supfile.StrictEnv. Defined are vars, the env vars
+// of the network's hosts, the env vars captured by capture_env, sup's runtime
+// env vars, the remote shell's own vars and the process environment.
+func (conf *Supfile) checkEnv(network *Network, vars EnvList, commands []*Command) []error {
+	defined := func(name string) bool {
+		if conf.alwaysDefined(name) {
+			return true
+		}
+		if _, ok := vars.lookup(name); ok {
+			return true
+		}
+		for _, env := range network.HostEnv {
+			if _, ok := env.lookup(name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	pre, post, err := conf.networkHooks(network)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	checked := make(map[string]bool)
+	for _, cmd := range append(append(pre, commands...), post...) {
+		for _, err := range conf.checkCommandEnv(cmd, defined, checked) {
+			errs = append(errs, fmt.Errorf("network %v: %v", network.Name, err))
+		}
+	}
+	return errs
+}
+
+// checkSupfileEnv returns errors of references to env vars the Supfile never
+// defines, of its env and its commands, checked by Validate before any network
+// is resolved. Defined are the env vars of the Supfile, of any network or its
+// hosts and the alwaysDefined ones. Commands may be run on hosts listed
+// by an inventory, whose env vars aren't known until resolved; so commands are
+// checked by checkEnv only, if any network has an inventory.
+func (conf *Supfile) checkSupfileEnv() []error {
+	networkDefined := make(map[string]bool)
+	inventory := false
+	for _, network := range conf.Networks.nets {
+		if network.Inventory != "" || network.InventoryFile != "" {
+			inventory = true
+		}
+		for _, v := range network.Env {
+			networkDefined[v.Key] = true
+		}
+		for _, entry := range network.Hosts {
+			if _, env, err := parseHostEnv(entry); err == nil {
+				for _, v := range env {
+					networkDefined[v.Key] = true
+				}
+			}
+		}
+	}
+	defined := func(name string) bool {
+		if networkDefined[name] || conf.alwaysDefined(name) {
+			return true
+		}
+		_, ok := conf.Env.lookup(name)
+		return ok
+	}
+
+	var errs []error
+	for _, v := range conf.Env {
+		for _, name := range undefinedVars(v.Value, defined) {
+			errs = append(errs, fmt.Errorf("env %v references undefined $%v", v.Key, name))
+		}
+	}
+	if inventory {
+		return errs
+	}
+	checked := make(map[string]bool)
+	for _, name := range conf.Commands.Names {
+		cmd := conf.Commands.cmds[name]
+		cmd.Name = name
+		errs = append(errs, conf.checkCommandEnv(&cmd, defined, checked)...)
+	}
+	return errs
+}
+
+// alwaysDefined reports whether the env var is defined on every network:
+// sup's runtime env vars, the remote shell's own vars, the process
+// environment and the env vars captured by capture_env.
+func (conf *Supfile) alwaysDefined(name string) bool {
+	if runtimeEnv[name] || shellVars[name] {
+		return true
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return true
+	}
+	for _, cmd := range conf.Commands.cmds {
+		if cmd.CaptureEnv == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCommandEnv returns errors of references of the command and its
+// on_failure command to env vars defined doesn't know, nor their own env or
+// body defines. Commands already checked are skipped.
+func (conf *Supfile) checkCommandEnv(cmd *Command, defined func(name string) bool, checked map[string]bool) []error {
+	if checked[cmd.Name] {
+		return nil
+	}
+	checked[cmd.Name] = true
+
+	fields := [][2]string{
+		{"run", cmd.Run},
+		{"local", cmd.Local},
+		{"when", cmd.When},
+		{"dir", cmd.Dir},
+		{"changed", cmd.Changed},
+		{"skip_if", cmd.SkipIf},
+		{"args", cmd.Args},
+	}
+	for _, variant := range sortedKeys(cmd.RunVariants) {
+		fields = append(fields, [2]string{"run." + variant, cmd.RunVariants[variant]})
+	}
+	if cmd.Script != "" {
+		if data, err := ioutil.ReadFile(cmd.Script); err == nil {
+			fields = append(fields, [2]string{"script " + cmd.Script, string(data)})
+		}
+	}
+	for i, upload := range cmd.Upload {
+		fields = append(fields, [2]string{fmt.Sprintf("upload[%v].dst", i), upload.Dst})
+	}
+	for i, download := range cmd.Download {
+		fields = append(fields, [2]string{fmt.Sprintf("download[%v].src", i), download.Src})
+	}
+	cmdDefined := func(name string) bool {
+		if _, ok := cmd.Env.lookup(name); ok {
+			return true
+		}
+		return defined(name)
+	}
+	var errs []error
+	for _, field := range fields {
+		for _, name := range undefinedVars(field[1], cmdDefined) {
+			errs = append(errs, fmt.Errorf("command %v: %v references undefined $%v", cmd.Name, field[0], name))
+		}
+	}
+
+	if onFailure, ok := conf.Commands.cmds[cmd.OnFailure]; ok {
+		onFailure.Name = cmd.OnFailure
+		errs = append(errs, conf.checkCommandEnv(&onFailure, defined, checked)...)
+	}
+	return errs
+}
@@ -3,10 +3,15 @@ package sup
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/signal"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/goware/prefixer"
 	"github.com/pkg/errors"
@@ -19,30 +24,408 @@ type Stackup struct {
 	conf   *Supfile
 	debug  bool
 	prefix bool
+	dryRun bool
+
+	preflight time.Duration // Timeout of the hosts' reachability check, if any.
+
+	// Limits of the run, if any; see MaxParallel and UploadLimit.
+	maxParallel int
+	uploadLimit int64 // Bytes per second.
+
+	heartbeat time.Duration // Interval of the still running lines, if any.
+
+	grepRe *regexp.Regexp // Filter of the printed output lines, if any; see Grep.
+
+	interrupts *interrupts // Interrupts of the current run.
+
+	uploads *uploadState // State of incremental uploads, once loaded.
+
+	// Print each host's output as a block once it finishes? See BufferOutput.
+	bufferOutput bool
+	flushMu      sync.Mutex // Serializes the hosts' blocks.
+
+	// Confirmation of networks requiring it, see Network.Confirm.
+	assumeYes bool
+	prompt    func(prompt string) (string, error)
+
+	prefixTmpl *template.Template // Output prefix template, DefaultPrefixTemplate if nil.
+	noColor    bool               // Don't color the output prefixes?
+
+	// Host logs of the commands' output, if enabled; see HostLogs.
+	hostLogDir   string
+	hostLogName  *template.Template
+	hostLogsOnly bool      // Don't stream the commands' output?
+	logs         *hostLogs // Host logs of the current run.
+
+	hosts  []string // Glob patterns of the only hosts to run on, if any.
+	stdout io.Writer
+	stderr io.Writer
+	json   io.Writer
+	outMu  sync.Mutex // Serializes writes to stdout, stderr and json.
+	log    *Logger    // Writes sup's messages to stderr.
+
+	// Password fed to sudo of the commands run as another user.
+	sudoPass string
+
+	// Results of the running command and summaries of the run's commands.
+	results   *results
+	summary   []commandSummary
+	noSummary bool // Don't print the summary once the run is done?
+
+	// SSH connections, reused by subsequent runs until Close.
+	idle    map[string][]*SSHClient // Idle connections by "[bastion > ]user port identity_file ssh_options connect_timeout keepalive host".
+	busy    map[*SSHClient]string   // Connections in use and their keys.
+	connsMu sync.Mutex
 }
 
 func New(conf *Supfile) (*Stackup, error) {
-	return &Stackup{
+	sup := &Stackup{
 		conf: conf,
-	}, nil
+		log:  &Logger{},
+	}
+	sup.Stdout(os.Stdout)
+	sup.Stderr(os.Stderr)
+	return sup, nil
+}
+
+// ErrTaskFailed is returned when a task fails on one or more hosts.
+type ErrTaskFailed struct {
+	Hosts []ErrHost
+}
+
+// ErrTooManyFailures is returned when a command fails on more hosts than
+// its max_failures or max_failure_percent allow, even if it continues
+// on error. The command isn't run on the remaining hosts.
+type ErrTooManyFailures struct {
+	ErrTaskFailed
+	Limit string // Exceeded limit, ie. "max_failure_percent 25".
+}
+
+func (e ErrTooManyFailures) Error() string {
+	return fmt.Sprintf("aborted after %v failed host(s), over %v:\n%v", len(e.Hosts), e.Limit, e.ErrTaskFailed.Error())
+}
+
+// ErrHost represents failure of a task on a host.
+type ErrHost struct {
+	Prefix string
+	Err    error
+	client Client
+}
+
+// host returns the client of the failed host; the per host local
+// command failed on localhost is a failure of its host.
+func (e ErrHost) host() Client {
+	if local, ok := e.client.(*LocalhostClient); ok && local.target != nil {
+		return local.target
+	}
+	return e.client
+}
+
+func (e ErrTaskFailed) Error() string {
+	msgs := make([]string, len(e.Hosts))
+	for i, host := range e.Hosts {
+		msgs[i] = fmt.Sprintf("%s%v", host.Prefix, host.Err)
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// without returns the clients that didn't fail.
+func (e ErrTaskFailed) without(clients []Client) []Client {
+	if len(e.Hosts) == 0 {
+		return clients
+	}
+	var ok []Client
+	for _, c := range clients {
+		failed := false
+		for _, host := range e.Hosts {
+			if host.host() == c {
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			ok = append(ok, c)
+		}
+	}
+	return ok
+}
+
+// ExitStatus returns exit status of the first failed remote command,
+// or 1 if it didn't exit with a status.
+func (e ErrTaskFailed) ExitStatus() int {
+	if len(e.Hosts) > 0 {
+		if err, ok := e.Hosts[0].Err.(*ssh.ExitError); ok && err.ExitStatus() != 15 {
+			return err.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// ExitCode is ExitCommand, as returned by the package's ExitCode.
+func (e ErrTaskFailed) ExitCode() int {
+	return ExitCommand
+}
+
+// RunNamed runs the named commands and targets on the named network,
+// or the networks matching the glob pattern, ie. "staging-*",
+// with env vars overriding those defined in Supfile. With no commands,
+// the default one is run, see Supfile.DefaultCommand.
+func (sup *Stackup) RunNamed(network string, commands []string, env map[string]string) error {
+	if len(commands) == 0 {
+		if name, ok := sup.conf.DefaultCommand(); ok {
+			commands = []string{name}
+		}
+	}
+	nets, vars, err := sup.resolveNetworks(network, env)
+	if err != nil {
+		return err
+	}
+	cmds, err := sup.conf.ResolveCommands(commands...)
+	if err != nil {
+		return err
+	}
+	return sup.RunNetworks(nets, vars, cmds...)
+}
+
+// RunTagged runs the commands tagged by any of the tags, see
+// Supfile.ResolveTags, on the named network, or the networks matching
+// the glob pattern, with env vars overriding those defined in Supfile.
+func (sup *Stackup) RunTagged(network string, tags []string, env map[string]string) error {
+	nets, vars, err := sup.resolveNetworks(network, env)
+	if err != nil {
+		return err
+	}
+	cmds, err := sup.conf.ResolveTags(tags...)
+	if err != nil {
+		return err
+	}
+	return sup.RunNetworks(nets, vars, cmds...)
+}
+
+// RunAdHoc runs the raw command, ie. "uptime", not defined in Supfile
+// on the named network, with env vars overriding those defined in Supfile.
+func (sup *Stackup) RunAdHoc(network string, raw string, env map[string]string) error {
+	nets, vars, err := sup.resolveNetworks(network, env)
+	if err != nil {
+		return err
+	}
+	cmd, err := AdHocCommand(raw)
+	if err != nil {
+		return err
+	}
+	return sup.RunNetworks(nets, vars, cmd)
+}
+
+// resolveNetworks resolves the named network, or the networks matching
+// the glob pattern, and env vars overriding theirs.
+func (sup *Stackup) resolveNetworks(network string, env map[string]string) ([]*Network, EnvList, error) {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var vars EnvList
+	for _, key := range keys {
+		vars.Set(key, env[key])
+	}
+
+	nets, err := sup.conf.ResolveNetworks(network, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nets, vars, nil
 }
 
 // Run runs set of commands on multiple hosts defined by network sequentially.
+// SSH connections are kept open for subsequent runs until Close.
+func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) (err error) {
+	sup.summary = nil
+	start := time.Now()
+	defer func() { sup.done([]*Network{network}, commands, start, err) }()
+	if sup.conf.StrictEnv {
+		if errs := sup.conf.checkEnv(network, envVars, commands); len(errs) > 0 {
+			return ErrInvalidSupfile{errs}
+		}
+	}
+	if err := sup.openHostLogs(start); err != nil {
+		return err
+	}
+	if err := sup.runHooks(sup.conf.Hooks.RunStart, newHookEvent("run_start", []*Network{network}, commands, nil), nil); err != nil {
+		return err
+	}
+	return sup.run(network, envVars, nil, commands...)
+}
+
+// RunNetworks runs set of commands on the networks, ie. resolved by
+// Supfile.ResolveNetworks, one after another, each with its own env vars
+// overridden by env, and its own bastions. It stops on the first network
+// the commands fail on.
+func (sup *Stackup) RunNetworks(networks []*Network, env EnvList, commands ...*Command) (err error) {
+	sup.summary = nil
+	start := time.Now()
+	defer func() { sup.done(networks, commands, start, err) }()
+	// Check all the networks before running on the first one.
+	if sup.conf.StrictEnv {
+		var errs []error
+		for _, network := range networks {
+			vars, err := sup.conf.EnvVars(network, env)
+			if err != nil {
+				return errors.Wrapf(err, "network %v", network.Name)
+			}
+			errs = append(errs, sup.conf.checkEnv(network, vars, commands)...)
+		}
+		if len(errs) > 0 {
+			return ErrInvalidSupfile{errs}
+		}
+	}
+	if err := sup.openHostLogs(start); err != nil {
+		return err
+	}
+	if err := sup.runHooks(sup.conf.Hooks.RunStart, newHookEvent("run_start", networks, commands, nil), nil); err != nil {
+		return err
+	}
+	for _, network := range networks {
+		vars, err := sup.conf.EnvVars(network, env)
+		if err != nil {
+			return errors.Wrapf(err, "network %v", network.Name)
+		}
+		n := len(sup.summary)
+		err = sup.run(network.withoutHostEnv(env), vars, env, commands...)
+		if len(networks) > 1 {
+			for i := n; i < len(sup.summary); i++ {
+				sup.summary[i].cmd += " (" + network.Name + ")"
+			}
+		}
+		if err != nil {
+			if len(networks) > 1 {
+				return errors.Wrapf(err, "network %v", network.Name)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// run runs the commands on the network, adding their results to the summary.
+// The overrides of envVars, if any, take precedence over the commands' env.
 // TODO: This megamoth method needs a big refactor and should be split
-//       to multiple smaller methods.
-func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) error {
+//
+//	to multiple smaller methods.
+func (sup *Stackup) run(network *Network, envVars, overrides EnvList, commands ...*Command) error {
 	if len(commands) == 0 {
 		return errors.New("no commands to be run")
 	}
 
+	// Run on the matching hosts only, if filtered.
+	if len(sup.hosts) > 0 {
+		hosts, err := sup.Hosts(network)
+		if err != nil {
+			return err
+		}
+		filtered := *network
+		filtered.Hosts = hosts
+		network = &filtered
+	}
+
+	// Network-wide commands run before and after the commands, if any.
+	pre, post, err := sup.conf.networkHooks(network)
+	if err != nil {
+		return err
+	}
+
+	// Run the run variants of the commands picked by the env vars, if any.
+	if pre, err = withRunVariants(pre, envVars); err != nil {
+		return err
+	}
+	if commands, err = withRunVariants(commands, envVars); err != nil {
+		return err
+	}
+	if post, err = withRunVariants(post, envVars); err != nil {
+		return err
+	}
+
+	// Resolve the commands' own env vars.
+	if pre, err = withCommandEnv(pre, envVars, overrides); err != nil {
+		return err
+	}
+	if commands, err = withCommandEnv(commands, envVars, overrides); err != nil {
+		return err
+	}
+	if post, err = withCommandEnv(post, envVars, overrides); err != nil {
+		return err
+	}
+	planned := append(append(pre, commands...), post...)
+
+	// Forwarding the SSH agent needs one running locally.
+	for _, cmd := range planned {
+		if network.withDefaults(cmd).forwardsAgent() {
+			if !agentRunning() {
+				sup.log.Warnf("%v: forward_agent is set, but no SSH agent is running locally ($SSH_AUTH_SOCK); the agent isn't forwarded", cmd.Name)
+			}
+			break
+		}
+	}
+
+	if sup.dryRun {
+		return sup.printPlan(sup.stdout, network, envVars, planned)
+	}
+	if err := sup.confirm(network, envVars, planned); err != nil {
+		return err
+	}
+
+	// Interrupts stop launching new work, see interrupts.
+	sup.interrupts = sup.trapInterrupts()
+	defer func() {
+		sup.interrupts.stop()
+		sup.interrupts = nil
+	}()
+	if sup.logs != nil {
+		sup.logs.network = network.Name
+	}
+
+	// Hold the network's lock until done, if it has one.
+	if network.Lock != nil {
+		release, err := sup.acquireLock(network, envVars)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := release(); err != nil {
+				sup.log.Warnf("%v", errors.Wrapf(err, "network %v: releasing lock failed", network.Name))
+			}
+		}()
+	}
+
 	env := envVars.AsExport()
 
 	// Create clients for every host (either SSH or Localhost).
+	// Hosts are dialed through the last of the chained bastions, if any.
 	var bastion *SSHClient
-	if network.Bastion != "" {
-		bastion = &SSHClient{}
-		if err := bastion.Connect(network.Bastion); err != nil {
-			return errors.Wrap(err, "connecting to bastion failed")
+	hops := network.BastionChain()
+	for i, hop := range hops {
+		if sup.interrupts.interrupted() {
+			return ErrInterrupted
+		}
+		hopNetwork := &Network{User: network.User, SSHOptions: network.SSHOptions, ConnectTimeout: network.ConnectTimeout, Keepalive: network.Keepalive}
+		if b := network.BastionConfig; b != nil {
+			if b.User != "" {
+				hopNetwork.User = b.User
+			}
+			hopNetwork.IdentityFile, hopNetwork.Port = b.IdentityFile, b.Port
+		}
+		c, err := sup.dial(hop, hopNetwork, bastion)
+		if err != nil {
+			return errors.Wrapf(err, "connecting to bastion %v (hop %v/%v) failed", hop, i+1, len(hops))
+		}
+		defer sup.release(c)
+		bastion = c
+	}
+
+	// Check the hosts are reachable before running anything on them.
+	if sup.preflight > 0 {
+		var err error
+		if network, err = sup.preflightCheck(network, bastion); err != nil {
+			return err
 		}
 	}
 
@@ -50,44 +433,53 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 	clientCh := make(chan Client, len(network.Hosts))
 	errCh := make(chan error, len(network.Hosts))
 
-	for i, host := range network.Hosts {
+	// Hosts of the clients, as listed by the network.
+	clientHosts := make(map[Client]string, len(network.Hosts))
+	var clientHostsMu sync.Mutex
+
+	for _, host := range network.Hosts {
 		wg.Add(1)
-		go func(i int, host string) {
+		go func(host string) {
 			defer wg.Done()
 
+			hostEnv := network.HostEnv[host].AsExport()
+
 			// Localhost client.
 			if host == "localhost" {
 				local := &LocalhostClient{
-					env: env + `export SUP_HOST="` + host + `";`,
+					env: env + hostEnv + `export SUP_HOST="` + host + `";`,
 				}
 				if err := local.Connect(host); err != nil {
 					errCh <- errors.Wrap(err, "connecting to localhost failed")
 					return
 				}
+				clientHostsMu.Lock()
+				clientHosts[local] = host
+				clientHostsMu.Unlock()
 				clientCh <- local
 				return
 			}
 
 			// SSH client.
-			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host + `";`,
-				user:  network.User,
-				color: Colors[i%len(Colors)],
+			if sup.interrupts.interrupted() {
+				errCh <- ErrInterrupted
+				return
 			}
-
-			if bastion != nil {
-				if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
+			remote, err := sup.dial(host, network, bastion)
+			if err != nil {
+				if bastion != nil {
 					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
-					return
-				}
-			} else {
-				if err := remote.Connect(host); err != nil {
+				} else {
 					errCh <- errors.Wrap(err, "connecting to remote host failed")
-					return
 				}
+				return
 			}
+			remote.env = env + hostEnv + `export SUP_HOST="` + host + `";`
+			clientHostsMu.Lock()
+			clientHosts[remote] = host
+			clientHostsMu.Unlock()
 			clientCh <- remote
-		}(i, host)
+		}(host)
 	}
 	wg.Wait()
 	close(clientCh)
@@ -97,10 +489,9 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 	var clients []Client
 	for client := range clientCh {
 		if remote, ok := client.(*SSHClient); ok {
-			defer remote.Close()
+			defer sup.release(remote)
 		}
-		_, prefixLen := client.Prefix()
-		if prefixLen > maxLen {
+		if prefixLen := len(sup.prefixText(client)); prefixLen > maxLen {
 			maxLen = prefixLen
 		}
 		clients = append(clients, client)
@@ -109,137 +500,761 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 		return errors.Wrap(err, "connecting to clients failed")
 	}
 
-	// Run command or run multiple commands defined by target sequentially.
-	for _, cmd := range commands {
-		// Translate command into task(s).
-		tasks, err := sup.createTasks(cmd, clients, env)
-		if err != nil {
-			return errors.Wrap(err, "creating task failed")
-		}
+	// Start hooks of the hosts may abort the run, ie. failing to lock them.
+	n := len(sup.summary)
+	if err := sup.runHostHooks(sup.conf.Hooks.HostStart, newHookEvent("host_start", []*Network{network}, planned, nil), network, envVars, clientHosts, n); err != nil {
+		return err
+	}
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var writers []io.Writer
-			var wg sync.WaitGroup
+	// Template data of the clients, for templated commands.
+	vars := newTemplateVars(network, &envVars, clientHosts)
 
-			// Run tasks on the provided clients.
-			for _, c := range task.Clients {
-				var prefix string
-				var prefixLen int
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
-				}
+	// runCommands runs the commands on the clients sequentially.
+	runCommands := func(commands []*Command, clients []Client) error {
+		// Failures of the commands continuing on error.
+		var runFailed ErrTaskFailed
 
-				err := c.Run(task)
+		// Run command or run multiple commands defined by target sequentially.
+		for _, cmd := range commands {
+			if sup.interrupts.interrupted() {
+				return ErrInterrupted
+			}
+			cmd = network.withDefaults(cmd)
+			cmdVars := cmd.envVars(envVars)
+			if cmd.When != "" {
+				ok, err := evalCondition(cmd.When, cmdVars)
 				if err != nil {
-					return errors.Wrap(err, prefix+"task failed")
+					return errors.Wrap(err, cmd.Name)
 				}
+				if !ok {
+					sup.log.Infof("Skipping %v: condition %q is false", cmd.Name, cmd.When)
+					sup.summary = append(sup.summary, commandSummary{cmd: cmd.Name, skipped: true})
+					continue
+				}
+			}
+			withUploads, err := cmd.withUploadsWhen(cmdVars)
+			if err != nil {
+				return errors.Wrap(err, cmd.Name)
+			}
+			cmd = withUploads
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
-					}
-				}(c)
-
-				// Copy over tasks's STDERR.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
-					}
-				}(c)
+			// Run the command once per value of its once_per env var.
+			cmdClients := clients
+			if cmd.OncePer != "" {
+				cmdClients = oncePerClients(network, clients, clientHosts, cmd.OncePer, cmdVars)
+			}
 
-				writers = append(writers, c.Stdin())
+			// Translate command into task(s).
+			tasks, err := sup.createTasks(cmd, cmdClients, env, vars)
+			if err != nil {
+				return errors.Wrap(err, "creating task failed")
 			}
 
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
+			// Run tasks sequentially.
+			if err := sup.runTasks(cmd, tasks, maxLen, cmd.ContinueOnError); err != nil {
+				failed, ok := err.(ErrTaskFailed)
+				tooMany, aborted := err.(ErrTooManyFailures)
+				if aborted {
+					failed, ok = tooMany.ErrTaskFailed, true
+				}
+				if ok && cmd.OnFailure != "" {
+					sup.runOnFailure(cmd, failed, env, envVars, overrides, vars, maxLen)
+				}
+				if aborted {
+					tooMany.Hosts = append(runFailed.Hosts, tooMany.Hosts...)
+					return tooMany
+				}
+				if !ok || !cmd.ContinueOnError {
+					if ok && len(runFailed.Hosts) > 0 {
+						runFailed.Hosts = append(runFailed.Hosts, failed.Hosts...)
+						return runFailed
 					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
+					return err
+				}
+
+				// Keep going on the remaining hosts.
+				runFailed.Hosts = append(runFailed.Hosts, failed.Hosts...)
+				clients = failed.without(clients)
+				if len(clients) == 0 {
+					return runFailed
+				}
+				sup.log.Errorf("%v failed on %v host(s), continuing on %v host(s)", cmd.Name, len(failed.Hosts), len(clients))
+			}
+
+			// Export the captured STDOUT to subsequent commands.
+			for _, task := range tasks {
+				if task.Capture != nil {
+					// Quoted as is, the output is no shell code to expand.
+					v := EnvVar{cmd.CaptureEnv, strings.TrimSpace(task.Capture.String())}
+					export := "export " + v.Key + "=" + shellQuote(v.Value) + ";"
+					envVars.Set(v.Key, v.Value)
+					env += export
 					for _, c := range clients {
-						c.WriteClose()
-					}
-				}()
-			}
-
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
-			signal.Notify(trap, os.Interrupt)
-			go func() {
-				for {
-					select {
-					case sig, ok := <-trap:
-						if !ok {
-							return
-						}
-						for _, c := range task.Clients {
-							err := c.Signal(sig)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
-							}
+						switch c := c.(type) {
+						case *SSHClient:
+							c.env += export
+						case *LocalhostClient:
+							c.env += export
 						}
 					}
 				}
-			}()
+			}
+		}
+
+		if len(runFailed.Hosts) > 0 {
+			return runFailed
+		}
+		return nil
+	}
 
-			// Wait for all I/O operations first.
-			wg.Wait()
+	// The network's pre commands set the hosts up for the commands and its
+	// post commands tear them down, on all the hosts, even if any failed.
+	err = runCommands(append(pre, commands...), clients)
+	if len(post) > 0 && !sup.interrupts.interrupted() {
+		if postErr := runCommands(post, clients); postErr != nil {
+			if err != nil {
+				sup.log.Errorf("post commands of network %v failed:\n%v", network.Name, postErr)
+			} else {
+				err = postErr
+			}
+		}
+	}
+	if sup.interrupts.interrupted() && err != nil && err != ErrInterrupted {
+		// Failures of the work in flight, ie. of aborted uploads.
+		sup.log.Errorf("%v", err)
+		err = ErrInterrupted
+	}
+	if hookErr := sup.runHostHooks(sup.conf.Hooks.HostComplete, newHookEvent("host_complete", []*Network{network}, planned, err), network, envVars, clientHosts, n); hookErr != nil {
+		sup.log.Warnf("%v", hookErr)
+	}
+	return err
+}
 
-			// Make sure each client finishes the task, return on failure.
-			for _, c := range task.Clients {
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					if err := c.Wait(); err != nil {
-						var prefix string
-						if sup.prefix {
-							var prefixLen int
-							prefix, prefixLen = c.Prefix()
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
+// Hosts returns the hosts of the network commands are run on, ie. resolved
+// by Supfile.ResolveNetwork and matching OnlyHosts, if set.
+func (sup *Stackup) Hosts(network *Network) ([]string, error) {
+	if len(sup.hosts) == 0 {
+		return network.Hosts, nil
+	}
+	for _, pattern := range sup.hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "host filter %q", pattern)
+		}
+	}
+	var hosts []string
+	for _, host := range network.Hosts {
+		if matchHost(sup.hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts of network %v match %q", network.Name, strings.Join(sup.hosts, ","))
+	}
+	return hosts, nil
+}
 
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
-					}
-				}(c)
+// oncePerClients returns a client per distinct value of the key, the one
+// of the host listed first by the network. See Network.oncePer.
+func oncePerClients(network *Network, clients []Client, clientHosts map[Client]string, key string, env EnvList) []Client {
+	byHost := make(map[string]Client, len(clients))
+	for _, c := range clients {
+		byHost[clientHosts[c]] = c
+	}
+	var hosts []string
+	for _, host := range network.Hosts {
+		if _, ok := byHost[host]; ok {
+			hosts = append(hosts, host)
+		}
+	}
+
+	var once []Client
+	for _, host := range network.oncePer(hosts, key, env) {
+		once = append(once, byHost[host])
+	}
+	return once
+}
+
+// runOnFailure runs the command's on_failure command on the clients
+// the command failed on. Failure of the on_failure command is only reported.
+func (sup *Stackup) runOnFailure(cmd *Command, failed ErrTaskFailed, env string, envVars, overrides EnvList, vars templateVars, maxLen int) {
+	found, ok := sup.conf.Commands.Get(cmd.OnFailure)
+	if !ok {
+		sup.log.Warnf("%v: unknown on_failure command %v", cmd.Name, cmd.OnFailure)
+		return
+	}
+	found.Name = cmd.OnFailure
+	hook, err := found.withRunVariant(envVars)
+	if err == nil {
+		hook, err = hook.withEnv(envVars, overrides)
+	}
+	if err != nil {
+		sup.log.Warnf("%v: %v", found.Name, err)
+		return
+	}
+
+	clients := make([]Client, len(failed.Hosts))
+	for i, host := range failed.Hosts {
+		clients[i] = host.host()
+	}
+
+	sup.log.Errorf("%v failed, running %v", cmd.Name, hook.Name)
+	tasks, err := sup.createTasks(hook, clients, env, vars)
+	if err != nil {
+		sup.log.Warnf("%v: %v", hook.Name, errors.Wrap(err, "creating task failed"))
+		return
+	}
+	if err := sup.runTasks(hook, tasks, maxLen, false); err != nil {
+		sup.log.Warnf("%v failed:\n%v", hook.Name, err)
+	}
+}
+
+// runTasks runs the command's tasks sequentially, stopping on the first
+// failure, unless continueOnError is set. Then the clients a task failed on
+// are skipped by the subsequent tasks and all the failures are returned once
+// the tasks are done. The command's results are added to the run's summary
+// and, in JSON mode, written once done.
+func (sup *Stackup) runTasks(cmd *Command, tasks []*Task, maxLen int, continueOnError bool) error {
+	sup.results = newResults(cmd.Name)
+	sup.results.grepped = sup.grepRe != nil && sup.json == nil
+	defer func() {
+		for _, task := range tasks {
+			if task.check != nil {
+				sup.results.checked(task.check)
+				break
+			}
+		}
+		for _, task := range tasks {
+			if task.skip != nil {
+				sup.results.skipped(task.skip)
+				break
+			}
+		}
+		if sup.uploads != nil {
+			if err := sup.uploads.save(); err != nil {
+				sup.log.Warnf("%v", err)
 			}
+		}
+		sup.summary = append(sup.summary, sup.results.summary())
+		if sup.json != nil {
+			if err := sup.results.write(sup.json); err != nil {
+				sup.log.Warnf("%v", errors.Wrap(err, "writing JSON failed"))
+			}
+		}
+		sup.results = nil
+	}()
 
-			// Wait for all commands to finish.
-			wg.Wait()
+	// Hosts the command may fail on before it's aborted.
+	hosts := make(map[Client]bool)
+	for _, task := range tasks {
+		for _, c := range task.Clients {
+			hosts[c] = true
+		}
+	}
+	maxFailures, limit := cmd.maxFailures(len(hosts))
 
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
+	var failed ErrTaskFailed
+	var skip *skipCheck
+	remaining := func(task *Task) []Client {
+		clients := failed.without(task.Clients)
+		if skip != nil {
+			clients = skip.without(clients)
 		}
+		return clients
 	}
+	for i := 0; i < len(tasks); i++ {
+		task := tasks[i]
+		if sup.interrupts.interrupted() {
+			return ErrInterrupted
+		}
+		task.Clients = remaining(task)
+		if task.skip != nil {
+			skip = task.skip
+		}
 
+		var err error
+		if task.pool != nil {
+			// The consecutive uploads of a pool are run by it.
+			var pooled []*Task
+			for ; i < len(tasks) && tasks[i].pool == task.pool; i++ {
+				if tasks[i].Clients = remaining(tasks[i]); len(tasks[i].Clients) > 0 {
+					pooled = append(pooled, tasks[i])
+				}
+			}
+			i--
+			if len(pooled) == 0 {
+				continue
+			}
+			err = sup.runPool(task.pool, pooled, maxLen)
+		} else {
+			if len(task.Clients) == 0 {
+				continue
+			}
+			err = sup.runTask(task, maxLen)
+		}
+		if task.skip != nil && sup.json == nil {
+			for _, c := range task.Clients {
+				if task.skip.passed(c) {
+					sup.log.logf(LevelInfo, sup.prefixOf(c, maxLen), "skipped, skip_if passed")
+				}
+			}
+		}
+		if err == nil {
+			continue
+		}
+		taskFailed, ok := err.(ErrTaskFailed)
+		if !ok || !continueOnError || task.pool != nil && task.pool.failFast {
+			return err
+		}
+		failed.Hosts = append(failed.Hosts, taskFailed.Hosts...)
+		if maxFailures >= 0 && len(failed.Hosts) > maxFailures {
+			return ErrTooManyFailures{failed, limit}
+		}
+	}
+
+	if len(failed.Hosts) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// runTask runs the task on its clients in parallel and waits for all of them
+// to finish. Failed clients run the task again, if the task is to be retried.
+func (sup *Stackup) runTask(task *Task, maxLen int) error {
+	var writers []io.Writer
+	var wg sync.WaitGroup
+
+	// Kill the task on clients that don't finish in time.
+	timers := make(map[Client]*time.Timer)
+
+	// Errors of writing the clients' output, by client index.
+	outErrs := make([]error, len(task.Clients))
+
+	// Print the clients still running periodically, until their output ends.
+	hb := sup.startHeartbeat(task, maxLen)
+	defer hb.stop()
+
+	// Run tasks on the provided clients.
+	for i, c := range task.Clients {
+		prefix := sup.prefixOf(c, maxLen)
+
+		err := c.Run(task)
+		if err != nil {
+			return errors.Wrap(err, prefix+"task failed")
+		}
+		timers[c] = sup.killAfter(task, c, prefix)
+		if sup.results != nil {
+			sup.results.of(c)
+		}
+
+		var output sync.WaitGroup
+		sup.copyOutput(task, c, prefix, &output, &outErrs[i])
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			output.Wait()
+			hb.done(c)
+		}(c)
+
+		writers = append(writers, c.Stdin())
+	}
+
+	// Copy over task's STDIN, preceded by the sudo password.
+	input := task.Input
+	if pass := sup.sudoInput(task); pass != nil {
+		if input != nil {
+			input = io.MultiReader(pass, input)
+		} else {
+			input = pass
+		}
+	}
+	if input != nil {
+		go func() {
+			writer := io.MultiWriter(writers...)
+			_, err := io.Copy(writer, input)
+			if errors.Cause(err) == errAborted {
+				sup.log.Warnf("%v", err)
+			} else if err != nil && err != io.EOF {
+				sup.log.Errorf("%v", errors.Wrap(err, "copying STDIN failed"))
+			}
+			// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
+			for _, c := range task.Clients {
+				c.WriteClose()
+			}
+		}()
+	}
+
+	// Pass interrupts of the run to the clients, see interrupts.
+	done := sup.interrupts.start(task)
+	defer done()
+
+	// Wait for all I/O operations first.
+	wg.Wait()
+
+	// Collect failures of the task on the clients.
+	var failed ErrTaskFailed
+	var failedMu sync.Mutex
+
+	// Make sure each client finishes the task, retry on failure.
+	for i, c := range task.Clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			prefix := sup.prefixOf(c, maxLen)
+
+			err := sup.wait(task, c, timers[c])
+			if err == nil {
+				err = outErrs[i]
+			}
+			err = task.guarded(c, err)
+
+			// The task's input can't be replayed. Interrupted runs stop
+			// retrying, failing with the last error.
+			delay := task.RetryDelay
+			for attempt := 1; err != nil && attempt <= task.Retry && task.Input == nil; attempt++ {
+				sup.log.logf(LevelWarn, prefix, "%v, retrying in %v (attempt %v/%v)", err, delay, attempt, task.Retry)
+				if !sup.interrupts.sleep(delay) {
+					break
+				}
+				if task.RetryBackoff {
+					delay *= 2
+				}
+				err = task.guarded(c, sup.rerun(task, c, prefix))
+			}
+
+			if sup.results != nil {
+				sup.results.done(c, err)
+			}
+			if err == nil {
+				task.uploaded.done(c)
+			}
+			if err != nil && task.Silent && sup.json == nil {
+				sup.printSilenced(c, prefix)
+			}
+			if err != nil {
+				failedMu.Lock()
+				defer failedMu.Unlock()
+				failed.Hosts = append(failed.Hosts, ErrHost{prefix, err, c})
+			}
+		}(i, c)
+	}
+
+	// Wait for all commands to finish.
+	wg.Wait()
+
+	if len(failed.Hosts) > 0 {
+		return failed
+	}
 	return nil
 }
 
+// rerun runs the task on a single client again and waits for it to finish.
+func (sup *Stackup) rerun(task *Task, c Client, prefix string) error {
+	if task.Capture != nil {
+		task.Capture.Reset()
+	}
+	if err := c.Run(task); err != nil {
+		return err
+	}
+	timer := sup.killAfter(task, c, prefix)
+
+	if pass := sup.sudoInput(task); pass != nil {
+		go func() {
+			if _, err := io.Copy(c.Stdin(), pass); err != nil {
+				sup.log.Errorf("%v", errors.Wrap(err, prefix+"writing sudo password failed"))
+			}
+			c.WriteClose()
+		}()
+	}
+
+	var wg sync.WaitGroup
+	var outErr error
+	sup.copyOutput(task, c, prefix, &wg, &outErr)
+	wg.Wait()
+
+	if err := sup.wait(task, c, timer); err != nil {
+		return err
+	}
+	return outErr
+}
+
+// printSilenced prints the output of the silent command captured on the
+// failed client, so the failure can be debugged.
+func (sup *Stackup) printSilenced(c Client, prefix string) {
+	res := sup.results.of(c)
+	io.Copy(sup.log.lines(sup.stdout, LevelInfo), prefixer.New(strings.NewReader(res.stdout.String()), prefix))
+	io.Copy(sup.log.lines(sup.stderr, LevelWarn), prefixer.New(strings.NewReader(res.stderr.String()), prefix))
+}
+
+// sudoInput returns the sudo password to be written to STDIN of the task,
+// or nil if the task isn't run via sudo or there's no password.
+func (sup *Stackup) sudoInput(task *Task) io.Reader {
+	if task.Sudo == "" || sup.sudoPass == "" {
+		return nil
+	}
+	return strings.NewReader(sup.sudoPass + "\n")
+}
+
+// prefixOf returns the client's output prefix, left padded to maxLen.
+func (sup *Stackup) prefixOf(c Client, maxLen int) string {
+	if !sup.prefix {
+		return ""
+	}
+	prefix := sup.prefixText(c)
+	if len(prefix) < maxLen { // Left padding.
+		prefix = strings.Repeat(" ", maxLen-len(prefix)) + prefix
+	}
+	if sup.noColor {
+		return prefix
+	}
+	return hostColor(c.Host()) + prefix + ResetColor
+}
+
+// killAfter kills the task on the client once the task's timeout elapses.
+func (sup *Stackup) killAfter(task *Task, c Client, prefix string) *time.Timer {
+	if task.Timeout <= 0 {
+		return nil
+	}
+	return time.AfterFunc(task.Timeout, func() {
+		if err := c.Signal(os.Kill); err != nil {
+			sup.log.Errorf("%v", errors.Wrap(err, prefix+"killing timed out task failed"))
+		}
+	})
+}
+
+// copyOutput copies over the client's STDOUT and STDERR in the background.
+// Failure of consuming STDOUT by the task's Output is stored to outErr.
+func (sup *Stackup) copyOutput(task *Task, c Client, prefix string, wg *sync.WaitGroup, outErr *error) {
+	cmd := ""
+	if sup.results != nil {
+		cmd = sup.results.cmd
+	}
+
+	// Streamed output is written to stdout and stderr, or buffered until
+	// the client's output ends, if enabled.
+	stdoutW, stderrW := sup.stdout, sup.stderr
+	var buffered *hostOutput
+	if sup.bufferOutput {
+		buffered = &hostOutput{}
+		stdoutW, stderrW = buffered.writer(false), buffered.writer(true)
+	}
+	var copied sync.WaitGroup
+
+	// Copy over tasks's STDOUT.
+	copied.Add(1)
+	go func() {
+		defer copied.Done()
+		if task.Capture != nil {
+			if _, err := io.Copy(task.Capture, c.Stdout()); err != nil {
+				*outErr = errors.Wrap(err, "capturing STDOUT failed")
+			}
+			return
+		}
+		if task.Output != nil {
+			w, err := task.Output(c)
+			if err != nil {
+				*outErr = err
+				io.Copy(ioutil.Discard, c.Stdout())
+				return
+			}
+			_, err = io.Copy(w, c.Stdout())
+			if err == nil {
+				err = w.Close()
+			}
+			if err != nil {
+				*outErr = errors.Wrap(err, "writing STDOUT failed")
+			}
+			return
+		}
+		stdout := sup.logs.tee(c, cmd, c.Stdout())
+		if (sup.json != nil || task.Silent) && sup.results != nil {
+			io.Copy(&sup.results.of(c).stdout, stdout)
+			return
+		}
+		if sup.hostLogsOnly && sup.logs != nil {
+			io.Copy(ioutil.Discard, stdout)
+			return
+		}
+		_, err := io.Copy(sup.log.lines(stdoutW, LevelInfo), prefixer.New(sup.grep(c, stdout), prefix))
+		if err != nil && err != io.EOF {
+			// TODO: io.Copy() should not return io.EOF at all.
+			// Upstream bug? Or prefixer.WriteTo() bug?
+			sup.log.Errorf("%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
+		}
+	}()
+
+	// Copy over tasks's STDERR.
+	copied.Add(1)
+	go func() {
+		defer copied.Done()
+		stderr := sup.logs.tee(c, cmd, c.Stderr())
+		if (sup.json != nil || task.Silent) && sup.results != nil {
+			io.Copy(&sup.results.of(c).stderr, stderr)
+			return
+		}
+		if sup.hostLogsOnly && sup.logs != nil {
+			io.Copy(ioutil.Discard, stderr)
+			return
+		}
+		_, err := io.Copy(sup.log.lines(stderrW, LevelWarn), prefixer.New(sup.grep(c, stderr), prefix))
+		if err != nil && err != io.EOF {
+			sup.log.Errorf("%v", errors.Wrap(err, prefix+"reading STDERR failed"))
+		}
+	}()
+
+	// Flush the buffered output once both are copied.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		copied.Wait()
+		if buffered != nil {
+			buffered.flush(sup.stdout, sup.stderr, &sup.flushMu)
+		}
+	}()
+}
+
+// wait waits for the client to finish the task. The timer, if any,
+// was set to kill the task on its timeout. Exit codes the task ignores
+// are success.
+func (sup *Stackup) wait(task *Task, c Client, timer *time.Timer) error {
+	err := c.Wait()
+	if timer != nil && !timer.Stop() {
+		return fmt.Errorf("task timed out after %v", task.Timeout)
+	}
+	if err != nil && task.ignores(err) {
+		return nil
+	}
+	return err
+}
+
+// dial returns SSH client connected to the host with the network's user,
+// port and identity file, if any, optionally through the bastion.
+// It reuses an idle connection opened by previous runs, if any.
+// The client should be released once the run is done.
+func (sup *Stackup) dial(host string, network *Network, bastion *SSHClient) (*SSHClient, error) {
+	c := &SSHClient{}
+	if network == nil {
+		network = &Network{}
+	}
+	c.user = network.User
+	c.port = network.Port
+	c.identityFile = network.IdentityFile
+	c.sshOptions = network.SSHOptions
+	var err error
+	if c.timeout, err = network.connectTimeout(); err != nil {
+		return nil, err
+	}
+	if c.keepalive, err = network.keepalive(); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%v %v %v %q %v %v %v", c.user, c.port, c.identityFile, c.sshOptions, c.timeout, c.keepalive, host)
+
+	sup.connsMu.Lock()
+	if bastion != nil {
+		key = sup.busy[bastion] + " > " + key
+	}
+	if sup.busy == nil {
+		sup.idle = make(map[string][]*SSHClient)
+		sup.busy = make(map[*SSHClient]string)
+	}
+	if idle := sup.idle[key]; len(idle) > 0 {
+		c := idle[len(idle)-1]
+		sup.idle[key] = idle[:len(idle)-1]
+		sup.busy[c] = key
+		sup.connsMu.Unlock()
+		return c, nil
+	}
+	sup.connsMu.Unlock()
+
+	if bastion != nil {
+		err = c.ConnectWith(host, bastion.DialThrough)
+	} else {
+		err = c.Connect(host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sup.connsMu.Lock()
+	defer sup.connsMu.Unlock()
+	sup.busy[c] = key
+	return c, nil
+}
+
+// release returns SSH client obtained by dial to the idle connections.
+func (sup *Stackup) release(c *SSHClient) {
+	sup.connsMu.Lock()
+	defer sup.connsMu.Unlock()
+	if key, ok := sup.busy[c]; ok {
+		delete(sup.busy, c)
+		sup.idle[key] = append(sup.idle[key], c)
+	}
+}
+
+// Close closes all SSH connections opened by Run.
+func (sup *Stackup) Close() error {
+	sup.connsMu.Lock()
+	defer sup.connsMu.Unlock()
+
+	var err error
+	closeConn := func(c *SSHClient) {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range sup.busy {
+		closeConn(c)
+	}
+	for _, idle := range sup.idle {
+		for _, c := range idle {
+			closeConn(c)
+		}
+	}
+	sup.idle = nil
+	sup.busy = nil
+	return err
+}
+
+// Stdout sets the writer the commands' STDOUT is copied to.
+func (sup *Stackup) Stdout(w io.Writer) {
+	sup.stdout = &lockedWriter{&sup.outMu, w}
+}
+
+// Stderr sets the writer the commands' STDERR and sup's messages are written to.
+func (sup *Stackup) Stderr(w io.Writer) {
+	sup.stderr = &lockedWriter{&sup.outMu, w}
+	sup.log.w = sup.stderr
+}
+
+// lockedWriter serializes writes of multiple goroutines.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// JSON writes a JSON object per command run on a host to w, newline
+// delimited, instead of copying the commands' output to stdout and stderr.
+// See Result.
+func (sup *Stackup) JSON(w io.Writer) {
+	if w == nil {
+		sup.json = nil
+		return
+	}
+	sup.json = &lockedWriter{&sup.outMu, w}
+}
+
+// SudoPassword sets the password of sudo for the commands run as another
+// user. The password is written to the commands' STDIN; it's never printed.
+func (sup *Stackup) SudoPassword(password string) {
+	sup.sudoPass = password
+}
+
 func (sup *Stackup) Debug(value bool) {
 	sup.debug = value
 }
@@ -247,3 +1262,196 @@ func (sup *Stackup) Debug(value bool) {
 func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
+
+// OnlyHosts limits the hosts of the network the commands are run on to those
+// matching any of the comma-separated glob patterns, ie. "api1.example.com,db*".
+// Running on no hosts is an error.
+func (sup *Stackup) OnlyHosts(patterns string) {
+	sup.hosts = nil
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			sup.hosts = append(sup.hosts, pattern)
+		}
+	}
+}
+
+// PrefixTemplate sets the text/template of the hosts' output prefix,
+// ie. "[{{.Host}}] ". The template may use .Host, .Addr (host:port)
+// and .User, see DefaultPrefixTemplate.
+func (sup *Stackup) PrefixTemplate(text string) error {
+	tmpl, err := template.New("prefix").Parse(text)
+	if err != nil {
+		return errors.Wrap(err, "parsing prefix template failed")
+	}
+	if err := tmpl.Execute(ioutil.Discard, prefixData{}); err != nil {
+		return errors.Wrap(err, "executing prefix template failed")
+	}
+	sup.prefixTmpl = tmpl
+	return nil
+}
+
+// AssumeYes runs on networks requiring confirmation without asking for it.
+func (sup *Stackup) AssumeYes(value bool) {
+	sup.assumeYes = value
+}
+
+// Prompt sets the function asking the operator to confirm running on
+// networks requiring confirmation, returning the line the operator typed.
+// Without it, running on such networks fails, unless AssumeYes.
+func (sup *Stackup) Prompt(prompt func(prompt string) (string, error)) {
+	sup.prompt = prompt
+}
+
+// HostLogs writes the commands' output of every run to a file per host too,
+// in the directory, named by the text/template, ie. DefaultHostLogName.
+// The template may use .Host, .Network and .Time, the start of the run.
+// Files of a run are created anew, so names without .Time are overwritten
+// by the next run. Empty dir disables the host logs, which is the default.
+func (sup *Stackup) HostLogs(dir, name string) error {
+	tmpl, err := template.New("host log").Parse(name)
+	if err != nil {
+		return errors.Wrap(err, "parsing host log template failed")
+	}
+	if err := tmpl.Execute(ioutil.Discard, hostLogData{}); err != nil {
+		return errors.Wrap(err, "executing host log template failed")
+	}
+	sup.hostLogDir = dir
+	sup.hostLogName = tmpl
+	return nil
+}
+
+// HostLogsOnly writes the commands' output to the host logs only, if enabled,
+// instead of streaming it too.
+func (sup *Stackup) HostLogsOnly(value bool) {
+	sup.hostLogsOnly = value
+}
+
+// Color enables colors of the hosts' output prefixes, which is the default.
+// Each host has its own color, the same in every run.
+func (sup *Stackup) Color(value bool) {
+	sup.noColor = !value
+}
+
+// Timestamps prefixes sup's messages and the commands' output lines by
+// their time and level, ie. "2006-01-02T15:04:05Z info ...". See Logger.
+func (sup *Stackup) Timestamps(value bool) {
+	sup.log.Timestamps(value)
+}
+
+// Verbosity sets the least severe level of sup's messages printed,
+// LevelInfo by default. The commands' output is always printed.
+func (sup *Stackup) Verbosity(level Level) {
+	sup.log.Verbosity(level)
+}
+
+// Summary enables the summary of the commands' results, printed to stderr
+// once the run is done, which is the default.
+func (sup *Stackup) Summary(value bool) {
+	sup.noSummary = !value
+}
+
+// done prints the summary of the run, and posts it to the Supfile's notify
+// webhook, if any. Failing to notify is only reported.
+func (sup *Stackup) done(networks []*Network, commands []*Command, start time.Time, err error) {
+	sup.closeHostLogs()
+	sup.printSummary()
+	if sup.dryRun {
+		return
+	}
+	n := newNotification(networks, sup.summary, start, err)
+	if len(sup.conf.Hooks.RunComplete) > 0 {
+		event := newHookEvent("run_complete", networks, commands, err)
+		event.Results = &n
+		if err := sup.runHooks(sup.conf.Hooks.RunComplete, event, nil); err != nil {
+			sup.log.Warnf("%v", err)
+		}
+	}
+	if sup.conf.Notify == nil {
+		return
+	}
+	if err := sup.conf.Notify.post(n); err != nil {
+		sup.log.Warnf("%v", errors.Wrap(err, "notifying webhook failed"))
+	}
+}
+
+// printSummary prints how many hosts each command of the run succeeded
+// and failed on, how long it took and the failed hosts, unless disabled.
+func (sup *Stackup) printSummary() {
+	if sup.noSummary || len(sup.summary) == 0 {
+		return
+	}
+	lines := []string{"Summary:"}
+	for _, s := range sup.summary {
+		if s.skipped {
+			lines = append(lines, fmt.Sprintf("- %v: skipped", s.cmd))
+			continue
+		}
+		changed := ""
+		if s.checked {
+			changed = fmt.Sprintf(" (%v changed)", s.changed)
+		}
+		skipped := ""
+		if s.skippedHosts > 0 {
+			skipped = fmt.Sprintf(", %v skipped", s.skippedHosts)
+		}
+		line := fmt.Sprintf("- %v: %v ok%v, %v failed%v (%v)", s.cmd, s.ok, changed, len(s.failed), skipped, s.duration)
+		if len(s.failed) > 0 {
+			line += ": " + strings.Join(s.failed, ", ")
+		}
+		lines = append(lines, line)
+		if len(s.unmatched) > 0 {
+			lines = append(lines, fmt.Sprintf("  no lines matched on %v ok host(s): %v", len(s.unmatched), strings.Join(s.unmatched, ", ")))
+		}
+	}
+	sup.log.Infof("%v", strings.Join(lines, "\n"))
+}
+
+// Preflight checks all the hosts are reachable, ie. their SSH servers
+// respond within the timeout, before running the commands. Unreachable
+// hosts are reported up front; they're an error, unless the network
+// continues on error. Zero timeout disables the check, which is the default.
+func (sup *Stackup) Preflight(timeout time.Duration) {
+	sup.preflight = timeout
+}
+
+// Grep filters the hosts' output printed by the pattern: only the lines
+// matching it are printed, prefixed by their host as usual, and the summary
+// lists the ok hosts none of theirs matched. Exit codes, JSON results and
+// host logs aren't filtered. Nil disables it, which is the default.
+func (sup *Stackup) Grep(re *regexp.Regexp) {
+	sup.grepRe = re
+}
+
+// MaxParallel limits the number of hosts running a command at once to n,
+// regardless of the networks' and commands' serial, which can only lower
+// it. Commands run on more hosts are run in batches of n hosts, as serial
+// commands are. Zero means unlimited, which is the default.
+func (sup *Stackup) MaxParallel(n int) {
+	sup.maxParallel = n
+}
+
+// UploadLimit limits the bandwidth of the uploads to the bytes per second,
+// in total across the hosts uploaded to at once. Zero means unlimited,
+// which is the default.
+func (sup *Stackup) UploadLimit(bytesPerSec int64) {
+	sup.uploadLimit = bytesPerSec
+}
+
+// Heartbeat prints a line per host still running a command every interval,
+// ie. "still running (2m0s elapsed)", to tell stuck hosts from silent ones.
+// It isn't printed in JSON mode. Zero disables it, which is the default.
+func (sup *Stackup) Heartbeat(interval time.Duration) {
+	sup.heartbeat = interval
+}
+
+// BufferOutput buffers each host's output of a command, printing it as
+// a contiguous block once the host finishes, instead of streaming the hosts'
+// output lines interleaved. The hosts finishing first are printed first.
+func (sup *Stackup) BufferOutput(value bool) {
+	sup.bufferOutput = value
+}
+
+// DryRun prints commands and hosts to be run on instead of running them.
+func (sup *Stackup) DryRun(value bool) {
+	sup.dryRun = value
+}
@@ -2,11 +2,21 @@ package sup
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -20,18 +30,128 @@ type Supfile struct {
 	Targets  Targets  `yaml:"targets"`
 	Env      EnvList  `yaml:"env"`
 	Version  string   `yaml:"version"`
+	Include  []string `yaml:"include"` // Supfiles to merge networks, commands, targets and env from.
+	Default  string   `yaml:"default"` // Command or target run if none is given; target "default" if empty.
+
+	// Host aliases of the networks' hosts, ie. "db-primary: postgres@$DB_HOST:5432".
+	Hosts map[string]string `yaml:"hosts"`
+
+	EnvFile         string `yaml:"env_file"`          // Dotenv file of env vars, overridden by env.
+	EnvFileOptional bool   `yaml:"env_file_optional"` // Ignore missing env_file?
+
+	Notify *Notify `yaml:"notify"` // Webhook the results of every run are posted to.
+	Hooks  Hooks   `yaml:"hooks"`  // External programs run at points of every run.
+
+	// Fail runs whose commands reference undefined env vars, ie. typos of
+	// $VERSION, before running anything, instead of expanding them to empty.
+	StrictEnv bool `yaml:"strict_env"`
+
+	RefreshInventory bool `yaml:"-"` // Re-run the networks' inventory commands, ignoring their caches?
+	StrictHosts      bool `yaml:"-"` // Error on hosts looking like aliases, ie. "db-primary", not defined?
 }
 
 // Network is group of hosts with extra custom env vars.
 type Network struct {
-	Env       EnvList  `yaml:"env"`
-	Inventory string   `yaml:"inventory"`
-	Hosts     []string `yaml:"hosts"`
-	Bastion   string   `yaml:"bastion"` // Jump host for the environment
+	Name              string   `yaml:"-"` // Network name.
+	Env               EnvList  `yaml:"env"`
+	EnvFile           string   `yaml:"env_file"`          // Dotenv file of env vars, overridden by env
+	EnvFileOptional   bool     `yaml:"env_file_optional"` // Ignore missing env_file?
+	Inventory         string   `yaml:"inventory"`
+	InventoryFile     string   `yaml:"inventory_file"`      // File listing hosts, one per line
+	InventoryFormat   string   `yaml:"inventory_format"`    // Format of the inventory, "lines" (default), "json" or "ini"
+	InventoryGroup    string   `yaml:"inventory_group"`     // Group of the "ini" inventory; all its hosts if empty
+	InventoryCache    string   `yaml:"inventory_cache"`     // File caching hosts listed by the inventory command
+	InventoryCacheTTL string   `yaml:"inventory_cache_ttl"` // Max age of the cache, ie. "10m"; it doesn't expire if empty
+	Hosts             []string `yaml:"hosts"`
+	ExcludeHosts      []string `yaml:"exclude_hosts"`     // Hosts to skip, exact names or glob patterns
+	Serial            int      `yaml:"serial"`            // Default max number of hosts processing a command in parallel
+	Bastion           string   `yaml:"bastion"`           // Jump host for the environment, or comma-separated chain of them
+	Bastions          []string `yaml:"bastions"`          // Chain of jump hosts, dialed in order
+	ContinueOnError   bool     `yaml:"continue_on_error"` // Default of the commands' continue_on_error
+	Port              int      `yaml:"port"`              // SSH port of hosts not specifying one, ie. "host:2222"
+	IdentityFile      string   `yaml:"identity_file"`     // SSH private key, tried before the default ones
+	SSHOptions        []string `yaml:"ssh_options"`       // SSH options of the hosts and bastions, ie. "ConnectTimeout=10"
+	ConnectTimeout    string   `yaml:"connect_timeout"`   // Max time of connecting to the hosts and bastions, "30s" by default
+	Confirm           bool     `yaml:"confirm"`           // Ask the operator to type the network name before running?
+	Keepalive         string   `yaml:"keepalive"`         // Interval of SSH keepalives of the connections, "30s" by default
+
+	// Extra env vars of hosts listed as "host KEY=value ...", see ResolveNetwork.
+	HostEnv map[string]EnvList `yaml:"-"`
+
+	// Re-run the inventory command, ignoring the cache? See Supfile.RefreshInventory.
+	RefreshInventory bool `yaml:"-"`
+
+	// SSH user of the hosts and bastions not specifying one as "user@host",
+	// ie. "deploy" or "$DEPLOY_USER"; the current user if empty.
+	User string `yaml:"user"`
+
+	// Commands run on all the hosts before the commands of every run on the
+	// network, and after them, even if they failed, ie. to enter and exit
+	// a maintenance mode.
+	Pre  []string `yaml:"pre"`
+	Post []string `yaml:"post"`
+
+	// Default shells of the commands, see Command.Shell. The local shell
+	// runs the inventory command too, "/bin/sh" by default.
+	Shell      string `yaml:"shell"`
+	LocalShell string `yaml:"local_shell"`
+
+	// Credentials of the bastion, set by a bastion object; Bastion is its host.
+	BastionConfig *Bastion `yaml:"-"`
+
+	// Named subgroups of the hosts, run on as "network:group", ie. "web" or
+	// "db"; they list hosts of the network, as listed by hosts.
+	Groups map[string][]string `yaml:"groups"`
+
+	// Forward the local SSH agent to the commands run on the hosts, ie. for
+	// git over SSH? Default of the commands' forward_agent.
+	ForwardAgent bool `yaml:"forward_agent"`
+
+	// Default max number of hosts the commands upload to at once, see
+	// Command.MaxUploadParallel.
+	MaxUploadParallel int `yaml:"max_upload_parallel"`
+
+	// Lock held by runs on the network, refusing to run if another run holds it.
+	Lock *Lock `yaml:"lock"`
+
+	// Group of the hosts run on, if resolved as "network:group".
+	Group string `yaml:"-"`
+}
+
+func (n *Network) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type network Network // Without the method, not to recurse.
+	err := unmarshal((*network)(n))
+
+	// A bastion object is the only type error, the other fields are set.
+	var object struct {
+		Bastion *Bastion `yaml:"bastion"`
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) == 1 && unmarshal(&object) == nil && object.Bastion != nil {
+		n.Bastion, n.BastionConfig = object.Bastion.Host, object.Bastion
+		return nil
+	}
+	return err
+}
 
-	// Should these live on Hosts too? We'd have to change []string to struct, even in Supfile.
-	User         string // `yaml:"user"`
-	IdentityFile string // `yaml:"identity_file"`
+// Bastion is a jump host of its own SSH credentials, configured independently
+// of the network's hosts, ie. of segmented networks. A bastion given by its
+// host only is dialed as the network's user.
+type Bastion struct {
+	Host         string `yaml:"host"`
+	User         string `yaml:"user"`          // The network's user if empty; "$VARS" are expanded.
+	IdentityFile string `yaml:"identity_file"` // SSH private key, tried before the default ones.
+	Port         int    `yaml:"port"`          // SSH port, unless host specifies one.
+}
+
+// Lock is an advisory lock of a network, held by a run on it from connecting
+// to the hosts until it's done, so concurrent runs, ie. deployments by two
+// operators, refuse to run. It's a local file, or acquired by a local command,
+// ie. of a lock on a shared host; "$VARS" of the network are expanded.
+type Lock struct {
+	File    string `yaml:"file"`    // Lock file created by the run holding the lock, ie. "/tmp/sup-$SUP_NETWORK.lock".
+	Command string `yaml:"command"` // Command acquiring the lock, exiting non-zero with the holder printed if it's held.
+	Release string `yaml:"release"` // Command releasing the lock acquired by command.
+	Timeout string `yaml:"timeout"` // Max time of waiting for the lock held by another run; none if empty.
 }
 
 // Networks is a list of user-defined networks
@@ -65,22 +185,141 @@ func (n *Networks) Get(name string) (Network, bool) {
 	return net, ok
 }
 
+// merge adds networks from other, overriding networks of the same name.
+func (n *Networks) merge(other Networks) {
+	if n.nets == nil {
+		n.nets = make(map[string]Network)
+	}
+	for _, name := range other.Names {
+		if _, ok := n.nets[name]; !ok {
+			n.Names = append(n.Names, name)
+		}
+		n.nets[name] = other.nets[name]
+	}
+}
+
 // Command represents command(s) to be run remotely.
 type Command struct {
-	Name   string   `yaml:"-"`      // Command name.
-	Desc   string   `yaml:"desc"`   // Command description.
-	Local  string   `yaml:"local"`  // Command(s) to be run locally.
-	Run    string   `yaml:"run"`    // Command(s) to be run remotelly.
-	Script string   `yaml:"script"` // Load command(s) from script and run it remotelly.
-	Upload []Upload `yaml:"upload"` // See Upload struct.
-	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
-	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
-	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
+	Name            string     `yaml:"-"`                 // Command name.
+	Desc            string     `yaml:"desc"`              // Command description.
+	Local           string     `yaml:"local"`             // Command(s) to be run locally.
+	LocalPerHost    bool       `yaml:"local_per_host"`    // Run the local command once per host, with its env vars?
+	Run             string     `yaml:"run"`               // Command(s) to be run remotelly.
+	Script          string     `yaml:"script"`            // Load command(s) from script and run it remotelly.
+	Args            string     `yaml:"args"`              // Arguments of the script, ie. "$VERSION --force".
+	Upload          []Upload   `yaml:"upload"`            // See Upload struct.
+	Download        []Download `yaml:"download"`          // See Download struct.
+	Stdin           bool       `yaml:"stdin"`             // Attach localhost STDOUT to remote commands' STDIN?
+	StdinFile       string     `yaml:"stdin_file"`        // File fed to STDIN of the commands.
+	StdinData       string     `yaml:"stdin_data"`        // Content fed to STDIN of the commands.
+	Once            bool       `yaml:"once"`              // The command should be run "once" (on one host only).
+	OncePer         string     `yaml:"once_per"`          // Env var the command is run once per value of, ie. "REGION".
+	Serial          int        `yaml:"serial"`            // Max number of clients processing a task in parallel.
+	Timeout         string     `yaml:"timeout"`           // Max duration of the command on a host, ie. "30s" or "5m".
+	When            string     `yaml:"when"`              // Condition the command is run on, ie. "$ENV == production".
+	Retry           int        `yaml:"retry"`             // Number of retries of the command failing on a host.
+	RetryDelay      string     `yaml:"retry_delay"`       // Delay between the retries, ie. "10s".
+	RetryBackoff    bool       `yaml:"retry_backoff"`     // Double the delay after each retry?
+	OnFailure       string     `yaml:"on_failure"`        // Command to be run on hosts the command failed on.
+	CaptureEnv      string     `yaml:"capture_env"`       // Env var to store STDOUT of the local command to.
+	User            string     `yaml:"user"`              // Remote user to run the command as (via sudo).
+	Sudo            bool       `yaml:"sudo"`              // Run the command via sudo (as root, unless user is set).
+	SudoHome        bool       `yaml:"sudo_home"`         // Set $HOME to the target user's home (sudo -H).
+	Dir             string     `yaml:"dir"`               // Remote directory the command is run in.
+	Requires        []string   `yaml:"requires"`          // Commands to be run before the command.
+	ContinueOnError bool       `yaml:"continue_on_error"` // Keep going on the remaining hosts if the command fails on some?
+	Changed         string     `yaml:"changed"`           // Remote command whose STDOUT differs if the command changed the host, ie. a checksum.
+	SkipIf          string     `yaml:"skip_if"`           // Remote command skipping the command on hosts it exits zero on, ie. already converged.
+	Silent          bool       `yaml:"silent"`            // Print the command's output only on hosts it fails on?
+	Pty             *bool      `yaml:"pty"`               // Request a pseudo-terminal for run and script? Defaults to true, as sup always did.
+
+	// Abort the command once it failed on more hosts, or percent of its hosts,
+	// even if it continues on error.
+	MaxFailures   int `yaml:"max_failures"`
+	MaxFailurePct int `yaml:"max_failure_percent"`
+
+	// Render run, local and script as Go templates, ie. "{{.Env.VERSION}}",
+	// see templateData. Opt-in, as commands may use "{{" literally.
+	Template bool `yaml:"template"`
+
+	Tags []string `yaml:"tags"` // Tags the command may be run by, ie. "db", see Supfile.ResolveTags.
+
+	IgnoreExit []int `yaml:"ignore_exit"` // Exit codes of run, script and local counting as success, ie. [1] of grep.
+
+	// Shell run and script are run by on the hosts, ie. "/bin/bash", instead
+	// of the remote user's login shell; and shell local is run by, "bash"
+	// by default.
+	Shell      string `yaml:"shell"`
+	LocalShell string `yaml:"local_shell"`
+
+	// Variants of run keyed by the value of the VariantBy env var, $SUP_NETWORK
+	// by default, ie. run: {staging: ..., production: ...}; the "default"
+	// variant is run unless one matches. Set by a map of run.
+	RunVariants map[string]string `yaml:"-"`
+	VariantBy   string            `yaml:"variant_by"`
+
+	// File run is loaded from, relative to the Supfile's directory, keeping
+	// large command bodies out of YAML.
+	RunFile string `yaml:"run_file"`
+
+	// Env vars of the command only, overriding those of the Supfile, the
+	// network and the hosts, but not -e overrides; see withEnv.
+	Env EnvList `yaml:"env"`
+
+	// Forward the local SSH agent to the command's sessions? Defaults to
+	// forward_agent of the network.
+	ForwardAgent *bool `yaml:"forward_agent"`
+
+	// Upload to up to this many hosts at once, by a tar stream each,
+	// independent of serial and --max-parallel. Failed uploads don't stop
+	// the ones to the other hosts, unless upload_fail_fast is set.
+	MaxUploadParallel int  `yaml:"max_upload_parallel"`
+	UploadFailFast    bool `yaml:"upload_fail_fast"`
 
 	// API backward compatibility. Will be deprecated in v1.0.
 	RunOnce bool `yaml:"run_once"` // The command should be run once only.
 }
 
+func (cmd *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type command Command // Without the method, not to recurse.
+	err := unmarshal((*command)(cmd))
+
+	// A map of run is the only type error, the other fields are set.
+	var variants struct {
+		Run map[string]string `yaml:"run"`
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) == 1 && unmarshal(&variants) == nil && len(variants.Run) > 0 {
+		cmd.Run, cmd.RunVariants = "", variants.Run
+		return nil
+	}
+	return err
+}
+
+// hasRun reports whether the command runs a run command, or its variants.
+func (cmd *Command) hasRun() bool {
+	return cmd.Run != "" || len(cmd.RunVariants) > 0
+}
+
+// variantBy returns the env var the command's run variant is picked by.
+func (cmd *Command) variantBy() string {
+	if cmd.VariantBy != "" {
+		return cmd.VariantBy
+	}
+	return "SUP_NETWORK"
+}
+
+// runVariant returns the key of the run variant picked by the value of
+// the variant_by env var, or false if none matches, nor there's a default.
+func (cmd *Command) runVariant(value string) (string, bool) {
+	if _, ok := cmd.RunVariants[value]; ok {
+		return value, true
+	}
+	if _, ok := cmd.RunVariants["default"]; ok {
+		return "default", true
+	}
+	return "", false
+}
+
 // Commands is a list of user-defined commands
 type Commands struct {
 	Names []string
@@ -112,6 +351,36 @@ func (c *Commands) Get(name string) (Command, bool) {
 	return cmd, ok
 }
 
+// requiresCycle returns the chain of commands required by the named command
+// that leads back to a command of the chain, if any.
+func (c *Commands) requiresCycle(name string, chain []string) []string {
+	chain = append(chain[:len(chain):len(chain)], name)
+	for _, required := range chain[:len(chain)-1] {
+		if required == name {
+			return chain
+		}
+	}
+	for _, required := range c.cmds[name].Requires {
+		if cycle := c.requiresCycle(required, chain); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// merge adds commands from other, overriding commands of the same name.
+func (c *Commands) merge(other Commands) {
+	if c.cmds == nil {
+		c.cmds = make(map[string]Command)
+	}
+	for _, name := range other.Names {
+		if _, ok := c.cmds[name]; !ok {
+			c.Names = append(c.Names, name)
+		}
+		c.cmds[name] = other.cmds[name]
+	}
+}
+
 // Targets is a list of user-defined targets
 type Targets struct {
 	Names   []string
@@ -143,12 +412,164 @@ func (t *Targets) Get(name string) ([]string, bool) {
 	return cmds, ok
 }
 
+// cycle returns the chain of targets referenced by the named target that
+// leads back to a target of the chain, if any. Entries naming a command
+// aren't target references.
+func (t *Targets) cycle(name string, chain []string, commands Commands) []string {
+	chain = append(chain[:len(chain):len(chain)], name)
+	for _, target := range chain[:len(chain)-1] {
+		if target == name {
+			return chain
+		}
+	}
+	for _, entry := range t.targets[name] {
+		if _, ok := commands.Get(entry); ok {
+			continue
+		}
+		if _, ok := t.targets[entry]; !ok {
+			continue
+		}
+		if cycle := t.cycle(entry, chain, commands); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// merge adds targets from other, overriding targets of the same name.
+func (t *Targets) merge(other Targets) {
+	if t.targets == nil {
+		t.targets = make(map[string][]string)
+	}
+	for _, name := range other.Names {
+		if _, ok := t.targets[name]; !ok {
+			t.Names = append(t.Names, name)
+		}
+		t.targets[name] = other.targets[name]
+	}
+}
+
 // Upload represents file copy operation from localhost Src path to Dst
 // path of every host in a given Network.
 type Upload struct {
+	Src      string `yaml:"src"`
+	Dst      string `yaml:"dst"`
+	Exc      string `yaml:"exclude"`
+	Compress *bool  `yaml:"compress"` // Gzip the tar stream? Defaults to true.
+	Mode     string `yaml:"mode"`     // Octal mode of the uploaded files, ie. "0600".
+	Owner    string `yaml:"owner"`    // Owner of the uploaded files, ie. "deploy" or "deploy:www-data".
+	When     string `yaml:"when"`     // Condition the upload is done on, like command.when.
+
+	// Paths uploaded instead of Src, set by a YAML list of src. Src and Srcs
+	// may be glob patterns, ie. "dist/*.js"; patterns matching no paths are
+	// an error, unless AllowEmpty.
+	Srcs       []string `yaml:"-"`
+	AllowEmpty bool     `yaml:"allow_empty"`
+
+	// Verify the uploaded files match the local ones by their sha256 checksums,
+	// failing the hosts they don't match on?
+	Verify bool `yaml:"verify"`
+
+	// Upload only the files modified since the last upload to the host,
+	// recorded by UploadStateFile; all of them if there's none.
+	Incremental bool `yaml:"incremental"`
+}
+
+// UnmarshalYAML unmarshals the upload, its src being a path or a list
+// of paths, set to Srcs.
+func (u *Upload) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type upload Upload // Without the method, not to recurse.
+	err := unmarshal((*upload)(u))
+
+	// A list of src is the only type error, the other fields are set.
+	var list struct {
+		Src []string `yaml:"src"`
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) == 1 && unmarshal(&list) == nil && len(list.Src) > 0 {
+		u.Src, u.Srcs = "", list.Src
+		return nil
+	}
+	return err
+}
+
+// sources returns the upload's paths, or glob patterns of them.
+func (u Upload) sources() []string {
+	if len(u.Srcs) > 0 {
+		return u.Srcs
+	}
+	return []string{u.Src}
+}
+
+// name names the upload by its sources in messages, ie. "dist/*, VERSION".
+func (u Upload) name() string {
+	return strings.Join(u.sources(), ", ")
+}
+
+// paths returns the local paths of the upload, its sources' $VARS expanded
+// by bash with the env, and glob patterns expanded relative to cwd.
+func (u Upload) paths(cwd, env string) ([]string, error) {
+	var paths []string
+	for _, src := range u.sources() {
+		path, err := ResolveLocalPath(cwd, src, env+"set -f;") // Not to glob by bash.
+		if err != nil {
+			return nil, err
+		}
+		if !strings.ContainsAny(path, "*?[") {
+			paths = append(paths, path)
+			continue
+		}
+		pattern := path
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(cwd, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "glob %q", path)
+		}
+		if len(matches) == 0 && !u.AllowEmpty {
+			return nil, fmt.Errorf("no paths match %q", path)
+		}
+		for _, match := range matches {
+			if !filepath.IsAbs(path) {
+				match, _ = filepath.Rel(cwd, match)
+			}
+			paths = append(paths, match)
+		}
+	}
+	return paths, nil
+}
+
+// compress reports whether the upload's tar stream is to be gzipped.
+func (u Upload) compress() bool {
+	return u.Compress == nil || *u.Compress
+}
+
+// templated reports whether the upload's dst is a Go template, rendered per
+// host, ie. "/srv/{{.Host}}/config"; see renderDsts.
+func (u Upload) templated() bool {
+	return strings.Contains(u.Dst, "{{")
+}
+
+var uploadOwnerRe = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._-]*(:[A-Za-z0-9._][A-Za-z0-9._-]*)?$`)
+
+// mode parses the upload's octal mode. Zero means the mode isn't set.
+func (u Upload) mode() (os.FileMode, error) {
+	if u.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(u.Mode, 8, 32)
+	if err != nil || len(u.Mode) < 3 || len(u.Mode) > 4 {
+		return 0, fmt.Errorf("invalid mode %q: expected octal mode, ie. \"0644\"", u.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Download represents file copy operation from Src path of every host
+// in a given Network to localhost Dst path. Dst may contain {{.Host}}
+// to download files of each host to a distinct directory.
+type Download struct {
 	Src string `yaml:"src"`
 	Dst string `yaml:"dst"`
-	Exc string `yaml:"exclude"`
 }
 
 // EnvVar represents an environment variable
@@ -178,6 +599,9 @@ func (e EnvList) Slice() []string {
 	return envs
 }
 
+// UnmarshalYAML unmarshals the env vars in order. Their values needn't be
+// quoted: numbers are kept as written, ie. "0755" or "1.10" rather than 493
+// or 1.1, booleans are "true" or "false" and nulls are empty.
 func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	items := []yaml.MapItem{}
 
@@ -186,10 +610,35 @@ func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	for _, v := range items {
+		switch v.Value.(type) {
+		case []interface{}, []yaml.MapItem, yaml.MapSlice, map[interface{}]interface{}:
+			return fmt.Errorf("env var %v: invalid value: expected a string, number or bool, not a list or map", v.Key)
+		}
+	}
+
+	// The scalars as written, not as resolved by YAML.
+	written := map[string]string{}
+	if err := unmarshal(&written); err != nil {
+		return err
+	}
+
 	*e = make(EnvList, 0, len(items))
 
 	for _, v := range items {
-		e.Set(fmt.Sprintf("%v", v.Key), fmt.Sprintf("%v", v.Value))
+		key := fmt.Sprintf("%v", v.Key)
+		value, ok := written[key]
+		switch resolved := v.Value.(type) {
+		case nil:
+			value = ""
+		case bool:
+			value = strconv.FormatBool(resolved)
+		default:
+			if !ok {
+				value = fmt.Sprintf("%v", resolved)
+			}
+		}
+		e.Set(key, value)
 	}
 
 	return nil
@@ -210,13 +659,45 @@ func (e *EnvList) Set(key, value string) {
 	})
 }
 
+// lookup returns value of the key in this list.
+func (e EnvList) lookup(key string) (string, bool) {
+	for _, v := range e {
+		if v.Key == key {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
 func (e *EnvList) ResolveValues() error {
+	return e.resolveValues(nil)
+}
+
+// resolveValues resolves the values like ResolveValues, except for
+// the literal ones, which are referenced as they are.
+func (e *EnvList) resolveValues(literal map[string]bool) error {
 	if len(*e) == 0 {
 		return nil
 	}
 
+	values := make(map[string]string, len(*e))
+	for _, v := range *e {
+		values[v.Key] = v.Value
+	}
+	values, err := resolveEnv(values, literal)
+	if err != nil {
+		return err
+	}
+	for _, v := range *e {
+		v.Value = values[v.Key]
+	}
+
 	exports := ""
 	for i, v := range *e {
+		if literal[v.Key] {
+			exports += "export " + v.Key + "=" + shellQuote(v.Value) + ";"
+			continue
+		}
 		exports += v.AsExport()
 
 		cmd := exec.Command("bash", "-c", exports+"echo -n "+v.Value+";")
@@ -236,16 +717,176 @@ func (e *EnvList) ResolveValues() error {
 	return nil
 }
 
-func (e *EnvList) AsExport() string {
+// runtimeEnv are env vars provided by sup when running commands.
+// Unless defined, references to them are left for the shell to expand.
+var runtimeEnv = map[string]bool{
+	"SUP_HOST":    true,
+	"SUP_NETWORK": true,
+	"SUP_USER":    true,
+	"SUP_TIME":    true,
+	"SUP_ENV":     true,
+}
+
+// resolveEnv expands $NAME and ${NAME} references in env values against
+// other env vars and the process environment. Values are resolved in
+// dependency order, so they may reference each other regardless of their
+// order. References to undefined vars and reference cycles are errors.
+// Literal values aren't expanded.
+func resolveEnv(env map[string]string, literal map[string]bool) (map[string]string, error) {
+	resolved := make(map[string]string, len(env))
+	for key := range literal {
+		if value, ok := env[key]; ok {
+			resolved[key] = value
+		}
+	}
+
+	var resolve func(key string, chain []string) (string, error)
+	resolve = func(key string, chain []string) (string, error) {
+		if value, ok := resolved[key]; ok {
+			return value, nil
+		}
+		for i, k := range chain {
+			if k == key {
+				return "", fmt.Errorf("env var cycle: %v", strings.Join(append(chain[i:], key), " -> "))
+			}
+		}
+		chain = append(chain, key)
+
+		value, err := expandEnv(env[key], func(name string) (string, bool, error) {
+			if _, ok := env[name]; ok && name != key {
+				value, err := resolve(name, chain)
+				return value, true, err
+			}
+			// Self-references, ie. PATH: $PATH:/opt/bin, refer to the process environment.
+			if value, ok := os.LookupEnv(name); ok {
+				return value, true, nil
+			}
+			if runtimeEnv[name] {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("env var %v references undefined $%v", key, name)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		resolved[key] = value
+		return value, nil
+	}
+
+	for key := range env {
+		if _, err := resolve(key, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, nil
+}
+
+// expandEnv replaces $NAME and ${NAME} references in s using lookup.
+// References lookup doesn't know, escaped dollar signs, single-quoted strings
+// and other shell expansions, ie. $(cmd) or ${NAME:-default}, are left as they are.
+func expandEnv(s string, lookup func(name string) (value string, ok bool, err error)) (string, error) {
+	var buf bytes.Buffer
+	quoted := false
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			buf.WriteString(s[i : i+2])
+			i++
+			continue
+		case s[i] == '\'':
+			quoted = !quoted
+		}
+		if s[i] != '$' || quoted {
+			buf.WriteByte(s[i])
+			continue
+		}
+
+		// Find the referenced name.
+		start, end, next := i+1, i+1, i+1
+		if end < len(s) && s[end] == '{' {
+			start++
+			end = strings.IndexByte(s[start:], '}') + start
+			if end < start || !isEnvName(s[start:end]) {
+				buf.WriteByte(s[i])
+				continue
+			}
+			next = end + 1
+		} else {
+			for end < len(s) && isEnvNameChar(s[end], end == start) {
+				end++
+			}
+			next = end
+		}
+		if end == start {
+			buf.WriteByte(s[i])
+			continue
+		}
+
+		value, ok, err := lookup(s[start:end])
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			buf.WriteString(s[i:next])
+		} else {
+			buf.WriteString(value)
+		}
+		i = next - 1
+	}
+
+	return buf.String(), nil
+}
+
+// expandVars replaces $NAME and ${NAME} references in s by values of the env
+// vars, or of the process environment. Undefined vars expand to empty strings.
+func expandVars(s string, env EnvList) (string, error) {
+	return expandEnv(s, func(name string) (string, bool, error) {
+		for _, v := range env {
+			if v.Key == name {
+				return v.Value, true, nil
+			}
+		}
+		return os.Getenv(name), true, nil
+	})
+}
+
+// isEnvName reports whether name is a valid env var name.
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+func (e EnvList) AsExport() string {
 	// Process all ENVs into a string of form
 	// `export FOO="bar"; export BAR="baz";`.
 	exports := ``
-	for _, v := range *e {
+	for _, v := range e {
 		exports += v.AsExport() + " "
 	}
 	return exports
 }
 
+var (
+	ErrUnknownNetwork = errors.New("Unknown network")
+	ErrNetworkNoHosts = errors.New("No hosts defined for a given network")
+	ErrCmd            = errors.New("Unknown command/target")
+	ErrAdHocEmpty     = errors.New("Empty ad-hoc command")
+)
+
 type ErrMustUpdate struct {
 	Msg string
 }
@@ -258,109 +899,1871 @@ func (e ErrMustUpdate) Error() string {
 	return fmt.Sprintf("%v\n\nPlease update sup by `go get -u github.com/pressly/sup/cmd/sup`", e.Msg)
 }
 
+func (e ErrMustUpdate) ExitCode() int {
+	return ExitConfig
+}
+
 func (e ErrUnsupportedSupfileVersion) Error() string {
 	return fmt.Sprintf("%v\n\nCheck your Supfile version (available latest version: v0.5)", e.Msg)
 }
 
+func (e ErrUnsupportedSupfileVersion) ExitCode() int {
+	return ExitConfig
+}
+
 // NewSupfile parses configuration file and returns Supfile or error.
 func NewSupfile(data []byte) (*Supfile, error) {
-	var conf Supfile
+	return NewSupfileNamed(data, "Supfile")
+}
 
-	if err := yaml.Unmarshal(data, &conf); err != nil {
+// NewSupfileNamed is like NewSupfile, prefixing YAML errors by the file name
+// and the line, ie. "Supfile.yml:14: cannot unmarshal ...". All the type
+// errors are reported at once, as ErrInvalidSupfile.
+func NewSupfileNamed(data []byte, name string) (*Supfile, error) {
+	conf, err := unmarshalSupfile(data, name, "", nil)
+	if err != nil {
 		return nil, err
 	}
+	return conf.prepare()
+}
 
-	// API backward compatibility. Will be deprecated in v1.0.
-	switch conf.Version {
-	case "":
-		conf.Version = "0.1"
-		fallthrough
-
-	case "0.1":
-		for _, cmd := range conf.Commands.cmds {
-			if cmd.RunOnce {
-				return nil, ErrMustUpdate{"command.run_once is not supported in Supfile v" + conf.Version}
-			}
+// NewSupfiles reads the Supfiles, see ReadSupfile, and merges them in order,
+// later ones over earlier ones, as includes: networks, commands and targets
+// of the same name are replaced, env vars and host aliases are set one by
+// one. The version and the default of the last file setting them are used,
+// with a warning if the files set different ones. The merged Supfile is
+// validated as a single file.
+func NewSupfiles(files ...string) (*Supfile, error) {
+	var merged Supfile
+	for i, file := range files {
+		name := file
+		if file == "-" {
+			name = "stdin"
+		}
+		data, err := ReadSupfile(file)
+		if err != nil {
+			return nil, errConfig{err}
+		}
+		conf, err := unmarshalSupfile(data, name, "", nil)
+		if err != nil {
+			return nil, err
 		}
-		fallthrough
 
-	case "0.2":
-		for _, cmd := range conf.Commands.cmds {
-			if cmd.Once {
-				return nil, ErrMustUpdate{"command.once is not supported in Supfile v" + conf.Version}
-			}
-			if cmd.Local != "" {
-				return nil, ErrMustUpdate{"command.local is not supported in Supfile v" + conf.Version}
-			}
-			if cmd.Serial != 0 {
-				return nil, ErrMustUpdate{"command.serial is not supported in Supfile v" + conf.Version}
+		if conf.Version != "" {
+			if merged.Version != "" && merged.Version != conf.Version {
+				DefaultLogger.Warnf("%v: version %v overrides version %v of %v", name, conf.Version, merged.Version, strings.Join(files[:i], ", "))
 			}
+			merged.Version = conf.Version
 		}
-		for _, network := range conf.Networks.nets {
-			if network.Inventory != "" {
-				return nil, ErrMustUpdate{"network.inventory is not supported in Supfile v" + conf.Version}
-			}
+		if conf.Default != "" && merged.Default != "" && merged.Default != conf.Default {
+			DefaultLogger.Warnf("%v: default %v overrides default %v of %v", name, conf.Default, merged.Default, strings.Join(files[:i], ", "))
 		}
-		fallthrough
+		merged.merge(conf)
+		merged.Include = append(merged.Include, conf.Include...)
+	}
+	return merged.prepare()
+}
 
-	case "0.3":
+// prepare validates the parsed Supfile, upgrades its deprecated fields
+// and resolves its secrets.
+func (conf *Supfile) prepare() (*Supfile, error) {
+	// API backward compatibility. Will be deprecated in v1.0.
+	if conf.Version == "" {
+		conf.Version = "0.1"
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Upgrade run_once once validated, so v0.2 Supfiles using it aren't
+	// taken for using command.once.
+	switch conf.Version {
+	case "0.2", "0.3", "0.4", "0.5":
 		var warning string
 		for key, cmd := range conf.Commands.cmds {
 			if cmd.RunOnce {
-				warning = "Warning: command.run_once was deprecated by command.once in Supfile v" + conf.Version + "\n"
+				warning = "command.run_once was deprecated by command.once in Supfile v" + conf.Version
 				cmd.Once = true
 				conf.Commands.cmds[key] = cmd
 			}
 		}
 		if warning != "" {
-			fmt.Fprintf(os.Stderr, warning)
+			DefaultLogger.Warnf("%v", warning)
 		}
+	}
 
-		fallthrough
-
-	case "0.4", "0.5":
-
-	default:
-		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + conf.Version}
+	if err := conf.resolveSecrets(); err != nil {
+		return nil, err
 	}
 
-	return &conf, nil
+	return conf, nil
 }
 
-// ParseInventory runs the inventory command, if provided, and appends
-// the command's output lines to the manually defined list of hosts.
-func (n Network) ParseInventory() ([]string, error) {
-	if n.Inventory == "" {
-		return nil, nil
-	}
-
-	cmd := exec.Command("/bin/sh", "-c", n.Inventory)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, n.Env.Slice()...)
-	cmd.Stderr = os.Stderr
-	output, err := cmd.Output()
+// NewSupfileFromReader is like NewSupfileNamed, reading the Supfile from r.
+func NewSupfileFromReader(r io.Reader, name string) (*Supfile, error) {
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "reading %v failed", name)
 	}
+	return NewSupfileNamed(data, name)
+}
 
-	var hosts []string
-	buf := bytes.NewBuffer(output)
-	for {
-		host, err := buf.ReadString('\n')
+// supfileFetchTimeout limits fetching the Supfile from a URL.
+const supfileFetchTimeout = 30 * time.Second
+
+// ReadSupfile reads the Supfile from the path; "-" reads STDIN and
+// "http://" or "https://" URLs are fetched. Includes and env files
+// of Supfiles not read from a file are relative to the working directory.
+func ReadSupfile(path string) ([]byte, error) {
+	switch {
+	case path == "-":
+		data, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+			return nil, errors.Wrap(err, "reading Supfile from STDIN failed")
 		}
-
-		host = strings.TrimSpace(host)
-		// skip empty lines and comments
-		if host == "" || host[:1] == "#" {
-			continue
+		return data, nil
+	case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+		client := &http.Client{Timeout: supfileFetchTimeout}
+		resp, err := client.Get(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching Supfile %v failed", path)
 		}
-
-		hosts = append(hosts, host)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching Supfile %v failed: %v", path, resp.Status)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching Supfile %v failed", path)
+		}
+		return data, nil
 	}
-	return hosts, nil
+	return ioutil.ReadFile(path)
+}
+
+// ErrInvalidSupfile lists all the problems found by Validate.
+type ErrInvalidSupfile struct {
+	Errors []error
+}
+
+func (e ErrInvalidSupfile) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e ErrInvalidSupfile) ExitCode() int {
+	return ExitConfig
+}
+
+// Validate checks the Supfile is supported by its version, that commands
+// and targets reference existing commands, and that durations, conditions,
+// patterns and other options are valid, and env var references if StrictEnv.
+// It returns ErrInvalidSupfile listing all the problems found, if any.
+func (conf *Supfile) Validate() error {
+	var errs []error
+
+	version := conf.Version
+	if version == "" {
+		version = "0.1"
+	}
+
+	// Report the first feature unsupported by the version only,
+	// they all call for the same update.
+	var mustUpdate error
+	unsupported := func(feature string) {
+		if mustUpdate == nil {
+			mustUpdate = ErrMustUpdate{feature + " is not supported in Supfile v" + version}
+		}
+	}
+
+	switch version {
+	case "0.1":
+		for _, cmd := range conf.Commands.cmds {
+			if cmd.RunOnce {
+				unsupported("command.run_once")
+			}
+		}
+		fallthrough
+
+	case "0.2":
+		for _, cmd := range conf.Commands.cmds {
+			if cmd.Once {
+				unsupported("command.once")
+			}
+			if cmd.Local != "" {
+				unsupported("command.local")
+			}
+			if cmd.Serial != 0 {
+				unsupported("command.serial")
+			}
+		}
+		for _, network := range conf.Networks.nets {
+			if network.Inventory != "" {
+				unsupported("network.inventory")
+			}
+		}
+		fallthrough
+
+	case "0.3":
+		if len(conf.Include) > 0 {
+			unsupported("include")
+		}
+		if conf.Default != "" {
+			unsupported("default")
+		}
+		if len(conf.Hosts) > 0 {
+			unsupported("hosts")
+		}
+		if conf.Notify != nil {
+			unsupported("notify")
+		}
+		if h := conf.Hooks; len(h.RunStart) > 0 || len(h.HostStart) > 0 || len(h.HostComplete) > 0 || len(h.RunComplete) > 0 {
+			unsupported("hooks")
+		}
+		if conf.EnvFile != "" {
+			unsupported("env_file")
+		}
+		if conf.StrictEnv {
+			unsupported("strict_env")
+		}
+		for _, v := range conf.Env {
+			if isSecret(v.Value) {
+				unsupported("env " + secretPrefix)
+			}
+		}
+		for _, name := range conf.Commands.Names {
+			cmd := conf.Commands.cmds[name]
+			switch {
+			case cmd.Timeout != "":
+				unsupported("command.timeout")
+			case cmd.When != "":
+				unsupported("command.when")
+			case cmd.Retry != 0 || cmd.RetryDelay != "" || cmd.RetryBackoff:
+				unsupported("command.retry")
+			case cmd.OnFailure != "":
+				unsupported("command.on_failure")
+			case cmd.CaptureEnv != "":
+				unsupported("command.capture_env")
+			case cmd.Args != "":
+				unsupported("command.args")
+			case len(cmd.Download) > 0:
+				unsupported("command.download")
+			case cmd.User != "":
+				unsupported("command.user")
+			case cmd.Sudo || cmd.SudoHome:
+				unsupported("command.sudo")
+			case cmd.Dir != "":
+				unsupported("command.dir")
+			case len(cmd.Requires) > 0:
+				unsupported("command.requires")
+			case cmd.ContinueOnError:
+				unsupported("command.continue_on_error")
+			case cmd.StdinFile != "":
+				unsupported("command.stdin_file")
+			case cmd.StdinData != "":
+				unsupported("command.stdin_data")
+			case cmd.OncePer != "":
+				unsupported("command.once_per")
+			case cmd.Changed != "":
+				unsupported("command.changed")
+			case cmd.Silent:
+				unsupported("command.silent")
+			case cmd.LocalPerHost:
+				unsupported("command.local_per_host")
+			case cmd.Pty != nil:
+				unsupported("command.pty")
+			case cmd.MaxFailures != 0 || cmd.MaxFailurePct != 0:
+				unsupported("command.max_failures")
+			case cmd.Template:
+				unsupported("command.template")
+			case len(cmd.Tags) > 0:
+				unsupported("command.tags")
+			case len(cmd.IgnoreExit) > 0:
+				unsupported("command.ignore_exit")
+			case cmd.Shell != "" || cmd.LocalShell != "":
+				unsupported("command.shell")
+			case cmd.SkipIf != "":
+				unsupported("command.skip_if")
+			case len(cmd.RunVariants) > 0 || cmd.VariantBy != "":
+				unsupported("map of command.run")
+			case cmd.RunFile != "":
+				unsupported("command.run_file")
+			case len(cmd.Env) > 0:
+				unsupported("command.env")
+			case cmd.ForwardAgent != nil:
+				unsupported("command.forward_agent")
+			case cmd.MaxUploadParallel != 0 || cmd.UploadFailFast:
+				unsupported("command.max_upload_parallel")
+			}
+			for _, upload := range cmd.Upload {
+				if upload.Compress != nil {
+					unsupported("command.upload.compress")
+				}
+				if upload.Mode != "" || upload.Owner != "" {
+					unsupported("command.upload.mode")
+				}
+				if upload.When != "" {
+					unsupported("command.upload.when")
+				}
+				if len(upload.Srcs) > 0 {
+					unsupported("list of command.upload.src")
+				}
+				if upload.AllowEmpty {
+					unsupported("command.upload.allow_empty")
+				}
+				if upload.Incremental {
+					unsupported("command.upload.incremental")
+				}
+				if upload.Verify {
+					unsupported("command.upload.verify")
+				}
+				if upload.templated() {
+					unsupported("template of command.upload.dst")
+				}
+			}
+		}
+		for _, name := range conf.Targets.Names {
+			for _, entry := range conf.Targets.targets[name] {
+				if _, ok := conf.Commands.Get(entry); ok {
+					continue
+				}
+				if _, ok := conf.Targets.Get(entry); ok {
+					unsupported("target referencing targets")
+				}
+			}
+		}
+		for _, name := range conf.Networks.Names {
+			network := conf.Networks.nets[name]
+			switch {
+			case network.InventoryFile != "":
+				unsupported("network.inventory_file")
+			case network.InventoryFormat != "":
+				unsupported("network.inventory_format")
+			case network.InventoryGroup != "":
+				unsupported("network.inventory_group")
+			case network.InventoryCache != "" || network.InventoryCacheTTL != "":
+				unsupported("network.inventory_cache")
+			case len(network.ExcludeHosts) > 0:
+				unsupported("network.exclude_hosts")
+			case network.Serial != 0:
+				unsupported("network.serial")
+			case network.EnvFile != "":
+				unsupported("network.env_file")
+			case network.Port != 0:
+				unsupported("network.port")
+			case network.User != "":
+				unsupported("network.user")
+			case network.Confirm:
+				unsupported("network.confirm")
+			case len(network.Pre) > 0 || len(network.Post) > 0:
+				unsupported("network.pre")
+			case network.Shell != "" || network.LocalShell != "":
+				unsupported("network.shell")
+			case network.ConnectTimeout != "":
+				unsupported("network.connect_timeout")
+			case network.Keepalive != "":
+				unsupported("network.keepalive")
+			case len(network.SSHOptions) > 0:
+				unsupported("network.ssh_options")
+			case network.IdentityFile != "":
+				unsupported("network.identity_file")
+			case network.ContinueOnError:
+				unsupported("network.continue_on_error")
+			case len(network.Bastions) > 0:
+				unsupported("network.bastions")
+			case network.BastionConfig != nil:
+				unsupported("network.bastion object")
+			case len(network.Groups) > 0:
+				unsupported("network.groups")
+			case network.ForwardAgent:
+				unsupported("network.forward_agent")
+			case network.MaxUploadParallel != 0:
+				unsupported("network.max_upload_parallel")
+			case network.Lock != nil:
+				unsupported("network.lock")
+			}
+			for _, v := range network.Env {
+				if isSecret(v.Value) {
+					unsupported("network.env " + secretPrefix)
+				}
+			}
+		}
+		fallthrough
+
+	case "0.4", "0.5":
+
+	default:
+		return ErrInvalidSupfile{[]error{ErrUnsupportedSupfileVersion{"unsupported Supfile version " + version}}}
+	}
+	if mustUpdate != nil {
+		errs = append(errs, mustUpdate)
+	}
+
+	for _, name := range conf.Commands.Names {
+		cmd := conf.Commands.cmds[name]
+		if _, err := cmd.timeout(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "command %v", name))
+		}
+		if cmd.Serial < 0 {
+			errs = append(errs, fmt.Errorf("command %v: invalid serial %v: must not be negative", name, cmd.Serial))
+		}
+		if cmd.MaxUploadParallel < 0 {
+			errs = append(errs, fmt.Errorf("command %v: invalid max_upload_parallel %v: must not be negative", name, cmd.MaxUploadParallel))
+		}
+		if cmd.OnFailure != "" {
+			if _, ok := conf.Commands.Get(cmd.OnFailure); !ok {
+				errs = append(errs, fmt.Errorf("command %v: on_failure references unknown command %q", name, cmd.OnFailure))
+			}
+		}
+		for _, v := range cmd.Env {
+			if !isEnvName(v.Key) {
+				errs = append(errs, fmt.Errorf("command %v: invalid env var %q", name, v.Key))
+			} else if runtimeEnv[v.Key] {
+				errs = append(errs, fmt.Errorf("command %v: env var %v is reserved: it's set by sup", name, v.Key))
+			}
+		}
+		if cmd.CaptureEnv != "" {
+			if cmd.Local == "" {
+				errs = append(errs, fmt.Errorf("command %v: capture_env is supported by local commands only", name))
+			}
+			if !isEnvName(cmd.CaptureEnv) {
+				errs = append(errs, fmt.Errorf("command %v: invalid capture_env %q", name, cmd.CaptureEnv))
+			}
+		}
+		if cmd.LocalPerHost {
+			if cmd.Local == "" {
+				errs = append(errs, fmt.Errorf("command %v: local_per_host is supported by local commands only", name))
+			}
+			if cmd.CaptureEnv != "" {
+				errs = append(errs, fmt.Errorf("command %v: capture_env is not supported by local_per_host commands", name))
+			}
+		}
+		if (cmd.User != "" || cmd.Sudo) && !cmd.hasRun() && cmd.Script == "" {
+			errs = append(errs, fmt.Errorf("command %v: user and sudo are supported by run and script commands only", name))
+		}
+		if cmd.MaxFailures < 0 {
+			errs = append(errs, fmt.Errorf("command %v: invalid max_failures %v: must not be negative", name, cmd.MaxFailures))
+		}
+		if cmd.MaxFailurePct < 0 || cmd.MaxFailurePct > 100 {
+			errs = append(errs, fmt.Errorf("command %v: invalid max_failure_percent %v: must be between 0 and 100", name, cmd.MaxFailurePct))
+		}
+		if cmd.Shell != "" && strings.TrimSpace(cmd.Shell) == "" {
+			errs = append(errs, fmt.Errorf("command %v: invalid shell %q", name, cmd.Shell))
+		}
+		if cmd.LocalShell != "" && strings.TrimSpace(cmd.LocalShell) == "" {
+			errs = append(errs, fmt.Errorf("command %v: invalid local_shell %q", name, cmd.LocalShell))
+		}
+		for _, code := range cmd.IgnoreExit {
+			if code < 0 || code > 255 {
+				errs = append(errs, fmt.Errorf("command %v: invalid ignore_exit code %v: must be between 0 and 255", name, code))
+			}
+		}
+		for _, tag := range cmd.Tags {
+			if strings.TrimSpace(tag) == "" || strings.Contains(tag, ",") {
+				errs = append(errs, fmt.Errorf("command %v: invalid tag %q", name, tag))
+			}
+		}
+		if cmd.Template {
+			if !cmd.hasRun() && cmd.Local == "" && cmd.Script == "" {
+				errs = append(errs, fmt.Errorf("command %v: template is supported by run, local and script commands only", name))
+			}
+			for _, body := range []struct{ field, body string }{{"run", cmd.Run}, {"local", cmd.Local}} {
+				if body.body == "" {
+					continue
+				}
+				if _, err := parseTemplate(body.field, body.body); err != nil {
+					errs = append(errs, errors.Wrapf(err, "command %v", name))
+				}
+			}
+			for _, key := range sortedKeys(cmd.RunVariants) {
+				if _, err := parseTemplate("run."+key, cmd.RunVariants[key]); err != nil {
+					errs = append(errs, errors.Wrapf(err, "command %v", name))
+				}
+			}
+		}
+		if cmd.Pty != nil && !cmd.hasRun() && cmd.Script == "" {
+			errs = append(errs, fmt.Errorf("command %v: pty is supported by run and script commands only", name))
+		}
+		if cmd.Changed != "" && !cmd.hasRun() && cmd.Script == "" {
+			errs = append(errs, fmt.Errorf("command %v: changed is supported by run and script commands only", name))
+		}
+		if cmd.Dir != "" && !cmd.hasRun() && cmd.Script == "" {
+			errs = append(errs, fmt.Errorf("command %v: dir is supported by run and script commands only", name))
+		}
+		if cmd.SkipIf != "" && cmd.Local != "" {
+			errs = append(errs, fmt.Errorf("command %v: skip_if is not supported by local commands", name))
+		}
+		if cmd.VariantBy != "" {
+			if len(cmd.RunVariants) == 0 {
+				errs = append(errs, fmt.Errorf("command %v: variant_by requires a map of run", name))
+			} else if !isEnvName(cmd.VariantBy) {
+				errs = append(errs, fmt.Errorf("command %v: invalid variant_by %q", name, cmd.VariantBy))
+			}
+		}
+		if len(cmd.RunVariants) > 0 && isEnvName(cmd.variantBy()) {
+			// The variant must be known of the networks' values, unless
+			// they're given at runtime, ie. by -e or $VARS.
+			for _, networkName := range conf.Networks.Names {
+				network, _ := conf.Networks.Get(networkName)
+				value, ok := networkName, cmd.variantBy() == "SUP_NETWORK"
+				if !ok {
+					if value, ok = network.Env.lookup(cmd.variantBy()); !ok {
+						value, ok = conf.Env.lookup(cmd.variantBy())
+					}
+				}
+				if !ok || strings.Contains(value, "$") {
+					continue
+				}
+				if _, ok := cmd.runVariant(value); !ok {
+					errs = append(errs, fmt.Errorf("command %v: run has no variant %q of $%v of network %v, nor default", name, value, cmd.variantBy(), networkName))
+				}
+			}
+		}
+		if cmd.SudoHome && cmd.User == "" && !cmd.Sudo {
+			errs = append(errs, fmt.Errorf("command %v: sudo_home requires user or sudo", name))
+		}
+		stdins := 0
+		for _, set := range []bool{cmd.Stdin, cmd.StdinFile != "", cmd.StdinData != ""} {
+			if set {
+				stdins++
+			}
+		}
+		if stdins > 1 {
+			errs = append(errs, fmt.Errorf("command %v: only one of stdin, stdin_file and stdin_data may be set", name))
+		}
+		if cmd.OncePer != "" {
+			if cmd.Once || cmd.RunOnce {
+				errs = append(errs, fmt.Errorf("command %v: only one of once and once_per may be set", name))
+			}
+			if !isEnvName(cmd.OncePer) {
+				errs = append(errs, fmt.Errorf("command %v: invalid once_per %q", name, cmd.OncePer))
+			}
+		}
+		if cmd.Args != "" && cmd.Script == "" {
+			errs = append(errs, fmt.Errorf("command %v: args are supported by script commands only", name))
+		}
+		if cmd.Retry < 0 {
+			errs = append(errs, fmt.Errorf("command %v: invalid retry %v: must not be negative", name, cmd.Retry))
+		}
+		if _, err := cmd.retryDelay(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "command %v", name))
+		}
+		if cmd.When != "" {
+			if _, _, _, err := parseCondition(cmd.When); err != nil {
+				errs = append(errs, errors.Wrapf(err, "command %v: when", name))
+			}
+		}
+		for _, upload := range cmd.Upload {
+			if _, err := upload.mode(); err != nil {
+				errs = append(errs, errors.Wrapf(err, "command %v: upload %v", name, upload.name()))
+			}
+			if upload.Owner != "" && !uploadOwnerRe.MatchString(upload.Owner) {
+				errs = append(errs, fmt.Errorf("command %v: upload %v: invalid owner %q", name, upload.name(), upload.Owner))
+			}
+			if upload.When != "" {
+				if _, _, _, err := parseCondition(upload.When); err != nil {
+					errs = append(errs, errors.Wrapf(err, "command %v: upload %v: when", name, upload.name()))
+				}
+			}
+			if upload.templated() {
+				if _, err := parseTemplate("dst", upload.Dst); err != nil {
+					errs = append(errs, errors.Wrapf(err, "command %v: upload %v", name, upload.name()))
+				}
+			}
+		}
+		for _, download := range cmd.Download {
+			if download.Src == "" || download.Dst == "" {
+				errs = append(errs, fmt.Errorf("command %v: download requires both src and dst", name))
+			}
+		}
+		for _, required := range cmd.Requires {
+			if _, ok := conf.Commands.Get(required); !ok {
+				errs = append(errs, fmt.Errorf("command %v: requires unknown command %q", name, required))
+			}
+		}
+	}
+	for _, name := range conf.Commands.Names {
+		if cycle := conf.Commands.requiresCycle(name, nil); cycle != nil {
+			errs = append(errs, fmt.Errorf("circular requires: %v", strings.Join(cycle, " -> ")))
+			break
+		}
+	}
+
+	for _, name := range conf.Targets.Names {
+		cmds := conf.Targets.targets[name]
+		if len(cmds) == 0 {
+			errs = append(errs, fmt.Errorf("target %q has no commands", name))
+		}
+		for _, cmd := range cmds {
+			if _, ok := conf.Commands.Get(cmd); ok {
+				continue
+			}
+			if _, ok := conf.Targets.Get(cmd); !ok {
+				errs = append(errs, fmt.Errorf("target %q references unknown command or target %q", name, cmd))
+			}
+		}
+	}
+	if conf.Default != "" {
+		_, isCommand := conf.Commands.Get(conf.Default)
+		_, isTarget := conf.Targets.Get(conf.Default)
+		if !isCommand && !isTarget {
+			errs = append(errs, fmt.Errorf("default references unknown command or target %q", conf.Default))
+		}
+	}
+	for _, v := range conf.Env {
+		if runtimeEnv[v.Key] {
+			errs = append(errs, fmt.Errorf("env var %v is reserved: it's set by sup", v.Key))
+		}
+	}
+	aliases := make([]string, 0, len(conf.Hosts))
+	for alias := range conf.Hosts {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if !hostAliasRe.MatchString(alias) || alias == "localhost" {
+			errs = append(errs, fmt.Errorf("invalid host alias %q: expected letters, digits, - and _", alias))
+		}
+		if strings.TrimSpace(conf.Hosts[alias]) == "" {
+			errs = append(errs, fmt.Errorf("host alias %v: missing address", alias))
+		}
+	}
+	for _, hooks := range []struct {
+		point string
+		hooks []string
+	}{
+		{"run_start", conf.Hooks.RunStart},
+		{"host_start", conf.Hooks.HostStart},
+		{"host_complete", conf.Hooks.HostComplete},
+		{"run_complete", conf.Hooks.RunComplete},
+	} {
+		for _, hook := range hooks.hooks {
+			if strings.TrimSpace(hook) == "" {
+				errs = append(errs, fmt.Errorf("hooks: invalid %v hook %q", hooks.point, hook))
+			}
+		}
+	}
+	if conf.Notify != nil {
+		if conf.Notify.URL == "" {
+			errs = append(errs, errors.New("notify: missing url"))
+		} else if u := conf.Notify.URL; !strings.Contains(u, "$") && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			errs = append(errs, fmt.Errorf("notify: invalid url %q: expected http(s) URL", conf.Notify.URL))
+		}
+	}
+	for _, name := range conf.Targets.Names {
+		if cycle := conf.Targets.cycle(name, nil, conf.Commands); cycle != nil {
+			errs = append(errs, fmt.Errorf("circular targets: %v", strings.Join(cycle, " -> ")))
+			break
+		}
+	}
+
+	for _, name := range conf.Networks.Names {
+		network := conf.Networks.nets[name]
+		switch network.InventoryFormat {
+		case "", "lines", "json", "ini":
+		default:
+			errs = append(errs, fmt.Errorf("network %v: unknown inventory_format %q", name, network.InventoryFormat))
+		}
+		if network.InventoryGroup != "" && network.InventoryFormat != "ini" {
+			errs = append(errs, fmt.Errorf("network %v: inventory_group requires inventory_format ini", name))
+		}
+		if network.InventoryCache != "" && network.Inventory == "" {
+			errs = append(errs, fmt.Errorf("network %v: inventory_cache requires inventory", name))
+		}
+		if _, err := network.inventoryCacheTTL(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "network %v", name))
+		}
+		if _, err := network.connectTimeout(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "network %v", name))
+		}
+		if _, err := network.keepalive(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "network %v", name))
+		}
+		if network.Serial < 0 {
+			errs = append(errs, fmt.Errorf("network %v: invalid serial %v: must not be negative", name, network.Serial))
+		}
+		if network.MaxUploadParallel < 0 {
+			errs = append(errs, fmt.Errorf("network %v: invalid max_upload_parallel %v: must not be negative", name, network.MaxUploadParallel))
+		}
+		if lock := network.Lock; lock != nil {
+			if (lock.File == "") == (lock.Command == "") {
+				errs = append(errs, fmt.Errorf("network %v: lock requires either file or command", name))
+			}
+			if lock.Release != "" && lock.Command == "" {
+				errs = append(errs, fmt.Errorf("network %v: lock release requires command", name))
+			}
+			if _, err := lock.timeout(); err != nil {
+				errs = append(errs, errors.Wrapf(err, "network %v: lock", name))
+			}
+		}
+		for _, hook := range network.Pre {
+			if _, ok := conf.Commands.Get(hook); !ok {
+				errs = append(errs, fmt.Errorf("network %v: pre references unknown command %q", name, hook))
+			}
+		}
+		for _, hook := range network.Post {
+			if _, ok := conf.Commands.Get(hook); !ok {
+				errs = append(errs, fmt.Errorf("network %v: post references unknown command %q", name, hook))
+			}
+		}
+		if network.Shell != "" && strings.TrimSpace(network.Shell) == "" {
+			errs = append(errs, fmt.Errorf("network %v: invalid shell %q", name, network.Shell))
+		}
+		if network.LocalShell != "" && strings.TrimSpace(network.LocalShell) == "" {
+			errs = append(errs, fmt.Errorf("network %v: invalid local_shell %q", name, network.LocalShell))
+		}
+		if network.Bastion != "" && len(network.Bastions) > 0 {
+			errs = append(errs, fmt.Errorf("network %v: only one of bastion and bastions may be set", name))
+		}
+		if b := network.BastionConfig; b != nil {
+			if strings.TrimSpace(b.Host) == "" || strings.Contains(b.Host, ",") {
+				errs = append(errs, fmt.Errorf("network %v: invalid bastion host %q: expected a single host", name, b.Host))
+			}
+			if strings.ContainsAny(b.User, "@ \t") {
+				errs = append(errs, fmt.Errorf("network %v: invalid bastion user %q", name, b.User))
+			}
+			if b.Port < 0 || b.Port > 65535 {
+				errs = append(errs, fmt.Errorf("network %v: invalid bastion port %v: must be between 1 and 65535", name, b.Port))
+			}
+		}
+		if strings.ContainsAny(network.User, "@ \t") {
+			errs = append(errs, fmt.Errorf("network %v: invalid user %q", name, network.User))
+		}
+		if network.Port < 0 || network.Port > 65535 {
+			errs = append(errs, fmt.Errorf("network %v: invalid port %v: must be between 1 and 65535", name, network.Port))
+		}
+		for _, v := range network.Env {
+			if runtimeEnv[v.Key] {
+				errs = append(errs, fmt.Errorf("network %v: env var %v is reserved: it's set by sup", name, v.Key))
+			}
+		}
+		for _, option := range network.SSHOptions {
+			if _, _, err := parseSSHOption(option); err != nil {
+				errs = append(errs, errors.Wrapf(err, "network %v: ssh_options", name))
+			}
+		}
+		for _, pattern := range network.ExcludeHosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, errors.Wrapf(err, "network %v: exclude_hosts %q", name, pattern))
+			}
+		}
+		if len(network.Groups) > 0 {
+			// Hosts listed by inventories aren't known until resolved.
+			listed := make(map[string]bool)
+			for _, entry := range network.Hosts {
+				if pattern, _, err := parseHostEnv(entry); err == nil {
+					listed[pattern] = true
+				}
+			}
+			inventory := network.Inventory != "" || network.InventoryFile != ""
+			for _, group := range network.GroupNames() {
+				if group == "" || strings.ContainsAny(group, ":*?[ \t") {
+					errs = append(errs, fmt.Errorf("network %v: invalid group name %q", name, group))
+					continue
+				}
+				for _, entry := range network.Groups[group] {
+					pattern, _, err := parseHostEnv(entry)
+					if err != nil {
+						errs = append(errs, errors.Wrapf(err, "network %v: group %v", name, group))
+						continue
+					}
+					if !listed[pattern] && !inventory {
+						errs = append(errs, fmt.Errorf("network %v: group %v references host %q not listed by hosts", name, group, entry))
+					}
+				}
+			}
+		}
+		if network.InventoryFile != "" {
+			if _, err := os.Stat(network.InventoryFile); err != nil {
+				errs = append(errs, errors.Wrapf(err, "network %v: inventory_file", name))
+			}
+		}
+	}
+
+	if conf.StrictEnv {
+		errs = append(errs, conf.checkSupfileEnv()...)
+	}
+
+	if len(errs) > 0 {
+		return ErrInvalidSupfile{errs}
+	}
+	return nil
+}
+
+// Lint complements Validate, reporting commands not referenced by any target,
+// nor by the default, another command's requires or on_failure, nor by
+// a network's pre or post. Such commands
+// may be left over, or meant to be run by name; so they're warnings, unless
+// strict, which returns ErrInvalidSupfile listing them instead.
+func (conf *Supfile) Lint(strict bool) error {
+	referenced := make(map[string]bool)
+	referenced[conf.Default] = true
+	for _, name := range conf.Targets.Names {
+		for _, entry := range conf.Targets.targets[name] {
+			referenced[entry] = true
+		}
+	}
+	for _, name := range conf.Commands.Names {
+		cmd := conf.Commands.cmds[name]
+		for _, required := range cmd.Requires {
+			referenced[required] = true
+		}
+		referenced[cmd.OnFailure] = true
+		if len(cmd.Tags) > 0 {
+			referenced[name] = true // Run by tags.
+		}
+	}
+	for _, name := range conf.Networks.Names {
+		network := conf.Networks.nets[name]
+		for _, hook := range append(network.Pre, network.Post...) {
+			referenced[hook] = true
+		}
+	}
+
+	var errs []error
+	for _, name := range conf.Commands.Names {
+		if !referenced[name] {
+			errs = append(errs, fmt.Errorf("command %v isn't referenced by any target", name))
+		}
+	}
+	if strict && len(errs) > 0 {
+		return ErrInvalidSupfile{errs}
+	}
+	for _, err := range errs {
+		DefaultLogger.Warnf("%v", err)
+	}
+	return nil
+}
+
+// retryDelay parses the command's delay between retries.
+func (cmd *Command) retryDelay() (time.Duration, error) {
+	if cmd.RetryDelay == "" {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(cmd.RetryDelay)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid retry_delay %q", cmd.RetryDelay)
+	}
+	if delay < 0 {
+		return 0, fmt.Errorf("invalid retry_delay %q: must not be negative", cmd.RetryDelay)
+	}
+	return delay, nil
+}
+
+// unmarshalSupfile parses configuration file of the name and merges
+// the Supfiles it includes into it. Relative include paths are resolved
+// against dir. The includes list holds the chain of files being included
+// to detect cycles.
+func unmarshalSupfile(data []byte, name, dir string, includes []string) (*Supfile, error) {
+	var conf Supfile
+
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, yamlError(err, name)
+	}
+	if err := conf.loadEnvFiles(dir); err != nil {
+		return nil, err
+	}
+	// Run and inventory files are relative to the top-level Supfile, not the
+	// working directory.
+	runDir := dir
+	if runDir == "" {
+		runDir = supfileDir(name)
+	}
+	if err := conf.loadRunFiles(runDir); err != nil {
+		return nil, err
+	}
+	conf.resolveInventoryFiles(runDir)
+
+	if len(conf.Include) == 0 {
+		return &conf, nil
+	}
+
+	// Later includes override earlier ones, the including file overrides them all.
+	var merged Supfile
+	for _, file := range conf.Include {
+		path := file
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "include %v", file)
+		}
+
+		chain := append(includes[:len(includes):len(includes)], path)
+		for _, included := range includes {
+			if included == path {
+				return nil, fmt.Errorf("circular include: %v", strings.Join(chain, " -> "))
+			}
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "include %v", file)
+		}
+		inc, err := unmarshalSupfile(data, file, filepath.Dir(path), chain)
+		if err != nil {
+			return nil, errors.Wrapf(err, "include %v", file)
+		}
+		merged.merge(inc)
+	}
+	merged.merge(&conf)
+	merged.Version = conf.Version
+	merged.Include = conf.Include
+
+	return &merged, nil
+}
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError prefixes the YAML error by the file name and the line, if known.
+// Type errors of multiple fields are listed by ErrInvalidSupfile.
+func yamlError(err error, name string) error {
+	located := func(msg string) error {
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			return fmt.Errorf("%v:%v: %v", name, m[1], m[2])
+		}
+		return fmt.Errorf("%v: %v", name, strings.TrimPrefix(msg, "yaml: "))
+	}
+
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		errs := make([]error, len(typeErr.Errors))
+		for i, msg := range typeErr.Errors {
+			errs[i] = located(msg)
+		}
+		return ErrInvalidSupfile{errs}
+	}
+	return ErrInvalidSupfile{[]error{located(err.Error())}}
+}
+
+// merge merges networks, commands, targets and env vars from other
+// into c. Values defined in other take precedence.
+func (c *Supfile) merge(other *Supfile) {
+	c.Networks.merge(other.Networks)
+	c.Commands.merge(other.Commands)
+	c.Targets.merge(other.Targets)
+	for _, v := range other.Env {
+		c.Env.Set(v.Key, v.Value)
+	}
+	if other.Default != "" {
+		c.Default = other.Default
+	}
+	if other.Notify != nil {
+		c.Notify = other.Notify
+	}
+	if other.StrictEnv {
+		c.StrictEnv = true
+	}
+	c.Hooks.merge(other.Hooks)
+	for alias, addr := range other.Hosts {
+		if c.Hosts == nil {
+			c.Hosts = make(map[string]string)
+		}
+		c.Hosts[alias] = addr
+	}
+}
+
+// DefaultCommand returns the command or target to be run if none is given:
+// the Supfile's default, or the target named "default". It's false
+// if there's none.
+func (conf *Supfile) DefaultCommand() (string, bool) {
+	if conf.Default != "" {
+		return conf.Default, true
+	}
+	if _, ok := conf.Targets.Get("default"); ok {
+		return "default", true
+	}
+	return "", false
+}
+
+// NetworkNames returns names of the Supfile's networks, sorted.
+func (conf *Supfile) NetworkNames() []string {
+	return sortedNames(conf.Networks.Names)
+}
+
+// CommandNames returns names of the Supfile's commands, sorted.
+func (conf *Supfile) CommandNames() []string {
+	return sortedNames(conf.Commands.Names)
+}
+
+// TargetNames returns names of the Supfile's targets, sorted.
+func (conf *Supfile) TargetNames() []string {
+	return sortedNames(conf.Targets.Names)
+}
+
+// Command returns the named command, with its Name set. It's false
+// if there's no such command.
+func (conf *Supfile) Command(name string) (Command, bool) {
+	cmd, ok := conf.Commands.Get(name)
+	if ok {
+		cmd.Name = name
+	}
+	return cmd, ok
+}
+
+// sortedNames returns a sorted copy of the names.
+func sortedNames(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// sortedKeys returns the sorted keys of the map.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withUploadsWhen returns the command without the uploads whose condition
+// is false with the env vars.
+func (cmd *Command) withUploadsWhen(env EnvList) (*Command, error) {
+	var uploads []Upload
+	for _, upload := range cmd.Upload {
+		if upload.When != "" {
+			ok, err := evalCondition(upload.When, env)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.name())
+			}
+			if !ok {
+				continue
+			}
+		}
+		uploads = append(uploads, upload)
+	}
+	if len(uploads) == len(cmd.Upload) {
+		return cmd, nil
+	}
+	copy := *cmd
+	copy.Upload = uploads
+	return &copy, nil
+}
+
+// withRunVariant returns the command running the run variant picked by
+// the env vars, if it has variants.
+func (cmd *Command) withRunVariant(env EnvList) (*Command, error) {
+	if len(cmd.RunVariants) == 0 {
+		return cmd, nil
+	}
+	value, _ := env.lookup(cmd.variantBy())
+	key, ok := cmd.runVariant(value)
+	if !ok {
+		return nil, fmt.Errorf("run has no variant %q of $%v, nor default", value, cmd.variantBy())
+	}
+	copy := *cmd
+	copy.Run, copy.RunVariants = cmd.RunVariants[key], nil
+	return &copy, nil
+}
+
+// withRunVariants returns the commands running their run variants picked
+// by the env vars, see Command.withRunVariant.
+func withRunVariants(commands []*Command, env EnvList) ([]*Command, error) {
+	picked := make([]*Command, len(commands))
+	for i, cmd := range commands {
+		var err error
+		if picked[i], err = cmd.withRunVariant(env); err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+	}
+	return picked, nil
+}
+
+// withEnv returns the command with its env vars resolved against vars, as
+// the env vars of the Supfile are, without the ones overridden by overrides,
+// ie. by -e, which take precedence over the command's.
+func (cmd *Command) withEnv(vars, overrides EnvList) (*Command, error) {
+	if len(cmd.Env) == 0 {
+		return cmd, nil
+	}
+	var merged EnvList
+	literal := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		merged.Set(v.Key, v.Value)
+		literal[v.Key] = true
+	}
+	for _, v := range cmd.Env {
+		if _, ok := overrides.lookup(v.Key); !ok {
+			merged.Set(v.Key, v.Value)
+			delete(literal, v.Key)
+		}
+	}
+	if err := merged.resolveValues(literal); err != nil {
+		return nil, err
+	}
+
+	c := *cmd
+	c.Env = nil
+	for _, v := range cmd.Env {
+		if _, ok := overrides.lookup(v.Key); !ok {
+			value, _ := merged.lookup(v.Key)
+			c.Env.Set(v.Key, value)
+		}
+	}
+	return &c, nil
+}
+
+// withCommandEnv returns the commands with their env vars resolved, see
+// Command.withEnv.
+func withCommandEnv(commands []*Command, vars, overrides EnvList) ([]*Command, error) {
+	resolved := make([]*Command, len(commands))
+	for i, cmd := range commands {
+		var err error
+		if resolved[i], err = cmd.withEnv(vars, overrides); err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+	}
+	return resolved, nil
+}
+
+// envVars returns the vars overridden by the command's resolved env vars.
+func (cmd *Command) envVars(vars EnvList) EnvList {
+	if len(cmd.Env) == 0 {
+		return vars
+	}
+	var merged EnvList
+	for _, list := range []EnvList{vars, cmd.Env} {
+		for _, v := range list {
+			merged.Set(v.Key, v.Value)
+		}
+	}
+	return merged
+}
+
+// maxFailures returns the number of the command's hosts it may fail on
+// before it's aborted, and the limit it's given by, or -1 if unlimited.
+// The stricter of max_failures and max_failure_percent applies.
+func (cmd *Command) maxFailures(hosts int) (int, string) {
+	max, limit := -1, ""
+	if cmd.MaxFailures > 0 {
+		max, limit = cmd.MaxFailures, fmt.Sprintf("max_failures %v", cmd.MaxFailures)
+	}
+	if cmd.MaxFailurePct > 0 {
+		if pct := hosts * cmd.MaxFailurePct / 100; max < 0 || pct < max {
+			max, limit = pct, fmt.Sprintf("max_failure_percent %v", cmd.MaxFailurePct)
+		}
+	}
+	return max, limit
+}
+
+// timeout parses the command's timeout. Zero means no timeout.
+func (cmd *Command) timeout() (time.Duration, error) {
+	if cmd.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(cmd.Timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid timeout %q", cmd.Timeout)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must not be negative", cmd.Timeout)
+	}
+	return timeout, nil
+}
+
+// Run runs the named commands and targets on the named network, with env vars
+// overriding those defined in Supfile. See Stackup for more options.
+func (conf *Supfile) Run(network string, commands []string, env map[string]string) error {
+	app, err := New(conf)
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+	return app.RunNamed(network, commands, env)
+}
+
+// ResolveNetwork returns the named network with its env vars overridden
+// by env and its hosts extended by hosts listed by its inventory.
+func (conf *Supfile) ResolveNetwork(name string, env EnvList) (*Network, error) {
+	network, ok := conf.Networks.Get(name)
+	group := ""
+	if !ok {
+		if name, group, ok = splitGroup(name); ok {
+			network, ok = conf.Networks.Get(name)
+		}
+		if !ok {
+			return nil, ErrUnknownNetwork
+		}
+		if _, ok := network.Groups[group]; !ok {
+			return nil, errConfig{fmt.Errorf("network %v has no group %v", name, group)}
+		}
+	}
+	network.Name = name
+	network.Group = group
+
+	// Copy env vars and hosts, so the Supfile's network stays intact.
+	var vars EnvList
+	for _, list := range []EnvList{network.Env, env} {
+		for _, v := range list {
+			vars.Set(v.Key, v.Value)
+		}
+	}
+	network.Env = vars
+	network.Hosts = append([]string{}, network.Hosts...)
+	network.RefreshInventory = network.RefreshInventory || conf.RefreshInventory
+
+	// Run the inventory with the resolved global and network env vars.
+	inventoryEnv := make(map[string]string)
+	if network.Inventory != "" {
+		vars, err := conf.EnvVars(&network, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vars {
+			inventoryEnv[v.Key] = v.Value
+		}
+	}
+	hosts, err := network.ParseInventory(inventoryEnv)
+	if err != nil {
+		return nil, err
+	}
+	network.Hosts = append(network.Hosts, hosts...)
+
+	// Env vars of the host aliases' addresses and the user, resolved
+	// once needed.
+	var aliasVars EnvList
+	resolveAliasVars := func() (EnvList, error) {
+		if aliasVars == nil {
+			vars, err := conf.EnvVars(&network, env)
+			if err != nil {
+				return nil, err
+			}
+			aliasVars = vars
+		}
+		return aliasVars, nil
+	}
+
+	if strings.Contains(network.User, "$") {
+		vars, err := resolveAliasVars()
+		if err != nil {
+			return nil, err
+		}
+		if network.User, err = expandVars(network.User, vars); err != nil {
+			return nil, errors.Wrapf(err, "network %v: user", name)
+		}
+	}
+	if b := network.BastionConfig; b != nil && strings.Contains(b.User, "$") {
+		vars, err := resolveAliasVars()
+		if err != nil {
+			return nil, err
+		}
+		bastion := *b
+		if bastion.User, err = expandVars(b.User, vars); err != nil {
+			return nil, errors.Wrapf(err, "network %v: bastion user", name)
+		}
+		network.BastionConfig = &bastion
+	}
+
+	// Split off per-host env vars, ie. "api1.example.com REGION=us-east-1",
+	// resolve host aliases and expand host ranges and sets, ie.
+	// "web[01-20].example.com". Duplicate hosts are dropped, keeping
+	// the first one; "user@host" and "host" are distinct hosts.
+	network.HostEnv = make(map[string]EnvList)
+	var expanded []string
+	seen := make(map[string]bool)
+	duplicates := 0
+	for _, entry := range network.Hosts {
+		pattern, hostEnv, err := parseHostEnv(entry)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err = conf.hostAlias(pattern, resolveAliasVars)
+		if err != nil {
+			return nil, errors.Wrapf(err, "network %v", name)
+		}
+		hosts, err := expandHost(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			if seen[host] {
+				duplicates++
+				continue
+			}
+			seen[host] = true
+			if len(hostEnv) > 0 {
+				network.HostEnv[host] = hostEnv
+			}
+			expanded = append(expanded, host)
+		}
+	}
+	network.Hosts = expanded
+	if duplicates > 0 {
+		DefaultLogger.Warnf("network %v: skipping %v duplicate host(s)", name, duplicates)
+	}
+
+	if len(network.ExcludeHosts) > 0 {
+		var hosts []string
+		for _, host := range network.Hosts {
+			if !network.excludes(host) {
+				hosts = append(hosts, host)
+			}
+		}
+		network.Hosts = hosts
+	}
+
+	// Run on the hosts of the group only, if targeted, resolved as the hosts.
+	if group != "" {
+		members := make(map[string]bool)
+		for _, entry := range network.Groups[group] {
+			pattern, _, err := parseHostEnv(entry)
+			if err != nil {
+				return nil, err
+			}
+			pattern, err = conf.hostAlias(pattern, resolveAliasVars)
+			if err != nil {
+				return nil, errors.Wrapf(err, "network %v: group %v", name, group)
+			}
+			hosts, err := expandHost(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range hosts {
+				members[host] = true
+			}
+		}
+		var hosts []string
+		for _, host := range network.Hosts {
+			if members[host] {
+				hosts = append(hosts, host)
+			}
+		}
+		network.Hosts = hosts
+	}
+
+	// Does the network have at least one host?
+	if len(network.Hosts) == 0 {
+		return nil, ErrNetworkNoHosts
+	}
+
+	return &network, nil
+}
+
+// ResolveNetworks resolves the network of the name, or the networks matching
+// it as a glob pattern, ie. "staging-*", in order. Matching networks without
+// hosts are skipped; hosts of multiple networks are run on as part of the
+// first one only.
+func (conf *Supfile) ResolveNetworks(pattern string, env EnvList) ([]*Network, error) {
+	if _, ok := conf.Networks.Get(pattern); ok || !strings.ContainsAny(pattern, "*?[") {
+		network, err := conf.ResolveNetwork(pattern, env)
+		if err != nil {
+			return nil, err
+		}
+		return []*Network{network}, nil
+	}
+
+	// Groups of the matching networks, ie. "*:db"; networks without
+	// the group are skipped.
+	pattern, group, grouped := splitGroup(pattern)
+
+	var networks []*Network
+	seen := make(map[string]bool)
+	matched := false
+	for _, name := range conf.Networks.Names {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "network pattern %q", pattern)
+		}
+		if !ok {
+			continue
+		}
+		resolved := name
+		if grouped {
+			if network, _ := conf.Networks.Get(name); network.Groups[group] == nil {
+				continue
+			}
+			resolved += ":" + group
+		}
+		matched = true
+		network, err := conf.ResolveNetwork(resolved, env)
+		if err == ErrNetworkNoHosts {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "network %v", name)
+		}
+
+		var hosts []string
+		for _, host := range network.Hosts {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+		if duplicates := len(network.Hosts) - len(hosts); duplicates > 0 {
+			DefaultLogger.Warnf("network %v: skipping %v host(s) of the previous networks", name, duplicates)
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		network.Hosts = hosts
+		networks = append(networks, network)
+	}
+	if !matched {
+		return nil, ErrUnknownNetwork
+	}
+	if len(networks) == 0 {
+		return nil, ErrNetworkNoHosts
+	}
+	return networks, nil
+}
+
+// splitGroup splits "network:group" to the network's name and the group,
+// or returns false if name isn't of a group.
+func splitGroup(name string) (network, group string, ok bool) {
+	i := strings.LastIndex(name, ":")
+	if i <= 0 || i == len(name)-1 {
+		return name, "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// GroupNames returns the sorted names of the network's groups.
+func (n *Network) GroupNames() []string {
+	names := make([]string, 0, len(n.Groups))
+	for name := range n.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BastionChain returns the jump hosts to be dialed in order, the hosts
+// are dialed through the last one.
+func (n *Network) BastionChain() []string {
+	if len(n.Bastions) > 0 {
+		return n.Bastions
+	}
+	var hops []string
+	for _, hop := range strings.Split(n.Bastion, ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// withDefaults returns the command with its unset options defaulting
+// to the network's ones.
+func (n *Network) withDefaults(cmd *Command) *Command {
+	c := *cmd
+	if c.Serial == 0 {
+		c.Serial = n.Serial
+	}
+	if n.ContinueOnError {
+		c.ContinueOnError = true
+	}
+	if c.Shell == "" {
+		c.Shell = n.Shell
+	}
+	if c.LocalShell == "" {
+		c.LocalShell = n.LocalShell
+	}
+	if c.ForwardAgent == nil && n.ForwardAgent {
+		c.ForwardAgent = &n.ForwardAgent
+	}
+	if c.MaxUploadParallel == 0 {
+		c.MaxUploadParallel = n.MaxUploadParallel
+	}
+	return &c
+}
+
+// withoutHostEnv returns the network without the env vars of its hosts
+// overridden by env, so the overrides take precedence on every host.
+func (n *Network) withoutHostEnv(env EnvList) *Network {
+	if len(env) == 0 || len(n.HostEnv) == 0 {
+		return n
+	}
+	copy := *n
+	copy.HostEnv = make(map[string]EnvList, len(n.HostEnv))
+	for host, hostEnv := range n.HostEnv {
+		var kept EnvList
+		for _, v := range hostEnv {
+			if _, ok := env.lookup(v.Key); !ok {
+				kept = append(kept, v)
+			}
+		}
+		copy.HostEnv[host] = kept
+	}
+	return &copy
+}
+
+// oncePer returns the first of the hosts for every distinct value of the
+// key among their per-host env vars, ie. one host per region. Hosts
+// without the key share its value in env.
+func (n *Network) oncePer(hosts []string, key string, env EnvList) []string {
+	var once []string
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		value, ok := n.HostEnv[host].lookup(key)
+		if !ok {
+			value, _ = env.lookup(key)
+		}
+		if !seen[value] {
+			seen[value] = true
+			once = append(once, host)
+		}
+	}
+	return once
+}
+
+// excludes reports whether the host matches any of the network's exclude_hosts,
+// with or without its "user@" part.
+func (n *Network) excludes(host string) bool {
+	return matchHost(n.ExcludeHosts, host)
+}
+
+// matchHost reports whether the host matches any of the glob patterns,
+// with or without its "user@" part.
+func matchHost(patterns []string, host string) bool {
+	name := host
+	if at := strings.Index(name, "@"); at != -1 {
+		name = name[at+1:]
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostEnv parses host entry of the form "host [KEY=value ...]".
+func parseHostEnv(entry string) (string, EnvList, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return entry, nil, nil
+	}
+
+	var env EnvList
+	for _, field := range fields[1:] {
+		i := strings.Index(field, "=")
+		if i < 1 || !isEnvName(field[:i]) {
+			return "", nil, fmt.Errorf("host %q: invalid env var %q, expected KEY=value", fields[0], field)
+		}
+		if runtimeEnv[field[:i]] {
+			return "", nil, fmt.Errorf("host %q: env var %v is reserved: it's set by sup", fields[0], field[:i])
+		}
+		env.Set(field[:i], field[i+1:])
+	}
+	return fields[0], env, nil
+}
+
+// ResolveCommands returns the named commands and commands of the named
+// targets, in order. Commands are preceded by the commands they require,
+// unless these are resolved to be run earlier.
+func (conf *Supfile) ResolveCommands(names ...string) ([]*Command, error) {
+	var commands []*Command
+
+	for _, name := range names {
+		// Target?
+		target, isTarget := conf.Targets.Get(name)
+		if isTarget {
+			var err error
+			commands, err = conf.withTarget(commands, target)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Command?
+		command, isCommand := conf.Commands.Get(name)
+		if isCommand {
+			command.Name = name
+			commands = conf.withRequires(commands, &command)
+		}
+
+		if !isTarget && !isCommand {
+			return nil, errConfig{fmt.Errorf("%v: %v", ErrCmd, name)}
+		}
+	}
+
+	return commands, nil
+}
+
+// ResolveTags returns the commands tagged by any of the tags, in the order
+// of the Supfile, preceded by the commands they require, as ResolveCommands.
+// Tags matching no command are an error.
+func (conf *Supfile) ResolveTags(tags ...string) ([]*Command, error) {
+	for _, tag := range tags {
+		matched := false
+		for _, name := range conf.Commands.Names {
+			if contains(conf.Commands.cmds[name].Tags, tag) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, errConfig{fmt.Errorf("no commands matched tag %q", tag)}
+		}
+	}
+
+	// Commands required by others, tagged too, are run once.
+	var commands []*Command
+	scheduled := func(name string) bool {
+		for _, c := range commands {
+			if c.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range conf.Commands.Names {
+		command := conf.Commands.cmds[name]
+		for _, tag := range tags {
+			if contains(command.Tags, tag) && !scheduled(name) {
+				command.Name = name
+				commands = conf.withRequires(commands, &command)
+				break
+			}
+		}
+	}
+	return commands, nil
+}
+
+// networkHooks returns the network's pre and post commands, each preceded
+// by the commands they require, as ResolveCommands.
+func (conf *Supfile) networkHooks(network *Network) (pre, post []*Command, err error) {
+	if pre, err = conf.ResolveCommands(network.Pre...); err != nil {
+		return nil, nil, errors.Wrapf(err, "network %v: pre", network.Name)
+	}
+	if post, err = conf.ResolveCommands(network.Post...); err != nil {
+		return nil, nil, errors.Wrapf(err, "network %v: post", network.Name)
+	}
+	return pre, post, nil
+}
+
+// AdHocCommand returns an ephemeral command running raw, ie. "uptime",
+// instead of one defined in Supfile. The command is named after raw.
+func AdHocCommand(raw string) (*Command, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, ErrAdHocEmpty
+	}
+	return &Command{Name: raw, Run: raw}, nil
+}
+
+// withTarget appends commands of the target to commands, expanding
+// the targets it references, recursively. An entry naming both
+// a command and a target is the command.
+func (conf *Supfile) withTarget(commands []*Command, target []string) ([]*Command, error) {
+	for _, name := range target {
+		command, isCommand := conf.Commands.Get(name)
+		if isCommand {
+			command.Name = name
+			commands = conf.withRequires(commands, &command)
+			continue
+		}
+		nested, isTarget := conf.Targets.Get(name)
+		if !isTarget {
+			return nil, errConfig{fmt.Errorf("%v: %v", ErrCmd, name)}
+		}
+		var err error
+		commands, err = conf.withTarget(commands, nested)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return commands, nil
+}
+
+// withRequires appends the command to commands, preceded by the commands
+// it requires, recursively, that aren't in commands yet.
+func (conf *Supfile) withRequires(commands []*Command, cmd *Command) []*Command {
+	for _, name := range cmd.Requires {
+		scheduled := false
+		for _, c := range commands {
+			if c.Name == name {
+				scheduled = true
+				break
+			}
+		}
+		if scheduled {
+			continue
+		}
+		required, ok := conf.Commands.Get(name)
+		if !ok {
+			continue
+		}
+		required.Name = name
+		commands = conf.withRequires(commands, &required)
+	}
+	return append(commands, cmd)
+}
+
+// EnvVars returns resolved env vars of commands run on the network,
+// ie. the global env vars overridden by the network's ones, and the default
+// $SUP_* env vars. The env vars are overridden by env, which also defines $SUP_ENV;
+// env values are taken literally and the other values referencing them
+// resolve to them, ie. IMAGE: app:$VERSION.
+// The $SUP_* env vars can't be overridden; $SUP_HOST is set per host.
+func (conf *Supfile) EnvVars(network *Network, env EnvList) (EnvList, error) {
+	for _, v := range env {
+		if runtimeEnv[v.Key] {
+			return nil, fmt.Errorf("env var %v is set by sup, it can't be overridden", v.Key)
+		}
+	}
+
+	var vars EnvList
+	for _, list := range []EnvList{conf.Env, network.Env} {
+		for _, v := range list {
+			vars.Set(v.Key, v.Value)
+		}
+	}
+
+	// Add default env variable with current network
+	vars.Set("SUP_NETWORK", network.Name)
+
+	// Add default nonce
+	vars.Set("SUP_TIME", time.Now().UTC().Format(time.RFC3339))
+	if os.Getenv("SUP_TIME") != "" {
+		vars.Set("SUP_TIME", os.Getenv("SUP_TIME"))
+	}
+
+	// Add user
+	if os.Getenv("SUP_USER") != "" {
+		vars.Set("SUP_USER", os.Getenv("SUP_USER"))
+	} else if os.Getenv("USER") != "" {
+		vars.Set("SUP_USER", os.Getenv("USER"))
+	} else if u, err := user.Current(); err == nil {
+		vars.Set("SUP_USER", u.Username)
+	}
+
+	// The overrides are referenced by the other values, as they are.
+	literal := make(map[string]bool, len(env))
+	supEnv := ""
+	for _, v := range env {
+		vars.Set(v.Key, v.Value)
+		literal[v.Key] = true
+		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
+	}
+	if err := vars.resolveValues(literal); err != nil {
+		return nil, err
+	}
+
+	// Define $SUP_ENV.
+	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
+
+	return vars, nil
+}
+
+// ParseInventory runs the inventory command with the given env vars
+// and reads the inventory file, if provided, and returns the hosts
+// they list to be appended to the manually defined list of hosts.
+// Hosts listed by the inventory command are reused from the inventory
+// cache within its TTL, if any.
+func (n Network) ParseInventory(env map[string]string) ([]string, error) {
+	var hosts []string
+
+	if n.Inventory != "" {
+		key := n.inventoryCacheKey(env)
+		inventory, ok := n.cachedInventory(key)
+		if !ok {
+			var err error
+			inventory, err = n.runInventory(env)
+			if err != nil {
+				return nil, err
+			}
+			if err := n.cacheInventory(key, inventory); err != nil {
+				DefaultLogger.Warnf("%v", errors.Wrap(err, "writing inventory cache failed"))
+			}
+		}
+		hosts = append(hosts, inventory...)
+	}
+
+	if n.InventoryFile != "" {
+		data, err := ioutil.ReadFile(n.InventoryFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading inventory file failed")
+		}
+		inventory, err := n.parseInventoryOutput(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing inventory file %v failed", n.InventoryFile)
+		}
+		hosts = append(hosts, inventory...)
+	}
+
+	return hosts, nil
+}
+
+// runInventory runs the inventory command with the given env vars
+// and returns the hosts it lists.
+func (n Network) runInventory(env map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cmd := shellCommand(n.LocalShell, "/bin/sh", n.Inventory)
+	cmd.Env = os.Environ()
+	for _, key := range keys {
+		cmd.Env = append(cmd.Env, key+"="+env[key])
+	}
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := n.parseInventoryOutput(output)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing output of inventory %q failed", n.Inventory)
+	}
+	return inventory, nil
+}
+
+// parseInventoryOutput parses hosts listed by the inventory in the network's
+// inventory format.
+func (n Network) parseInventoryOutput(data []byte) ([]string, error) {
+	switch n.InventoryFormat {
+	case "json":
+		return parseInventoryJSON(data)
+	case "ini":
+		hosts, warnings, err := parseInventoryINI(data, n.InventoryGroup)
+		for _, warning := range warnings {
+			DefaultLogger.Warnf("network %v: inventory %v", n.Name, warning)
+		}
+		return hosts, err
+	default:
+		return parseInventoryLines(data), nil
+	}
+}
+
+// parseInventoryJSON returns hosts listed as JSON array of strings,
+// or as "hosts" array of JSON object.
+func parseInventoryJSON(data []byte) ([]string, error) {
+	var hosts []string
+	if err := json.Unmarshal(data, &hosts); err == nil {
+		return hosts, nil
+	}
+
+	var object struct {
+		Hosts []string `json:"hosts"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, errors.Wrap(err, "expected JSON array of hosts or object with hosts array")
+	}
+	return object.Hosts, nil
+}
+
+// parseInventoryLines returns hosts listed one per line,
+// skipping empty lines and comments.
+func parseInventoryLines(data []byte) []string {
+	var hosts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		host := strings.TrimSpace(line)
+		if host == "" || host[:1] == "#" {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
 }
@@ -0,0 +1,139 @@
+package sup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveEnv(t *testing.T) {
+	t.Setenv("SUP_TEST_PATH", "/usr/bin")
+
+	tests := []struct {
+		env     map[string]string
+		literal map[string]bool
+		want    map[string]string
+		err     string
+	}{
+		{
+			env:  map[string]string{"A": "a"},
+			want: map[string]string{"A": "a"},
+		},
+		{
+			// Referenced before defined.
+			env:  map[string]string{"C": "$B-c", "B": "${A}-b", "A": "a"},
+			want: map[string]string{"A": "a", "B": "a-b", "C": "a-b-c"},
+		},
+		{
+			env:  map[string]string{"SUP_TEST_PATH": "$SUP_TEST_PATH:/opt/bin"},
+			want: map[string]string{"SUP_TEST_PATH": "/usr/bin:/opt/bin"},
+		},
+		{
+			env:  map[string]string{"A": `'$B' \$B $(date) ${B:-x} $SUP_HOST`},
+			want: map[string]string{"A": `'$B' \$B $(date) ${B:-x} $SUP_HOST`},
+		},
+		{
+			env:     map[string]string{"A": "$B", "B": "b"},
+			literal: map[string]bool{"A": true},
+			want:    map[string]string{"A": "$B", "B": "b"},
+		},
+		{
+			env:     map[string]string{"A": "$B", "B": "$$"},
+			literal: map[string]bool{"B": true},
+			want:    map[string]string{"A": "$$", "B": "$$"},
+		},
+		{
+			env: map[string]string{"A": "$SUP_TEST_UNDEFINED"},
+			err: "env var A references undefined $SUP_TEST_UNDEFINED",
+		},
+		{
+			// Self-references refer to the process environment only.
+			env: map[string]string{"A": "$A$B", "B": "$A"},
+			err: "env var A references undefined $A",
+		},
+		{
+			env: map[string]string{"A": "$B", "B": "$C", "C": "$A"},
+			err: "env var cycle: ",
+		},
+	}
+	for _, test := range tests {
+		got, err := resolveEnv(test.env, test.literal)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("resolveEnv(%v): got error %v, want %q", test.env, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveEnv(%v): %v", test.env, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("resolveEnv(%v): got %v, want %v", test.env, got, test.want)
+		}
+	}
+}
+
+func TestResolveEnvCycle(t *testing.T) {
+	_, err := resolveEnv(map[string]string{"A": "$B", "B": "$A"}, nil)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, cycle := range []string{"A -> B -> A", "B -> A -> B"} {
+		if err.Error() == "env var cycle: "+cycle {
+			return
+		}
+	}
+	t.Errorf("got %v, want the cycle of A and B", err)
+}
+
+func TestValidateVersion(t *testing.T) {
+	tests := []struct {
+		supfile string
+		err     string // Prefix of the only error.
+	}{
+		{supfile: "commands:\n  a:\n    run: echo\n"},
+		{supfile: "commands:\n  a:\n    run_once: true\n", err: "command.run_once is not supported in Supfile v0.1"},
+		{supfile: "version: 0.2\ncommands:\n  a:\n    run_once: true\n"},
+		{supfile: "version: 0.2\ncommands:\n  a:\n    once: true\n", err: "command.once is not supported in Supfile v0.2"},
+		{supfile: "version: 0.2\ncommands:\n  a:\n    local: echo\n", err: "command.local is not supported in Supfile v0.2"},
+		{supfile: "version: 0.3\ncommands:\n  a:\n    once: true\n    local: echo\n"},
+		{supfile: "version: 0.3\ncommands:\n  a:\n    when: $A\n", err: "command.when is not supported in Supfile v0.3"},
+		{supfile: "version: 0.3\ndefault: a\ncommands:\n  a:\n    run: echo\n", err: "default is not supported in Supfile v0.3"},
+		{supfile: "version: 0.3\nnetworks:\n  a:\n    exclude_hosts: [b]\n", err: "network.exclude_hosts is not supported in Supfile v0.3"},
+		{supfile: "version: 0.4\ndefault: a\ncommands:\n  a:\n    when: $A\n"},
+		{supfile: "version: 0.5\ndefault: a\ncommands:\n  a:\n    when: $A\n"},
+		{supfile: "version: 0.9\n", err: "unsupported Supfile version 0.9"},
+		{
+			// The first unsupported feature is reported only.
+			supfile: "version: 0.2\ncommands:\n  a:\n    local: echo\n    serial: 1\n",
+			err:     "command.local is not supported in Supfile v0.2",
+		},
+	}
+	for _, test := range tests {
+		_, err := NewSupfile([]byte(test.supfile))
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("NewSupfile(%q): %v", test.supfile, err)
+			}
+			continue
+		}
+		invalid, ok := err.(ErrInvalidSupfile)
+		if !ok || len(invalid.Errors) != 1 || !strings.HasPrefix(invalid.Errors[0].Error(), test.err) {
+			t.Errorf("NewSupfile(%q): got error %v, want %q", test.supfile, err, test.err)
+		}
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	for _, version := range []string{"0.2", "0.3", "0.4", "0.5"} {
+		conf, err := NewSupfile([]byte("version: " + version + "\ncommands:\n  a:\n    run_once: true\n"))
+		if err != nil {
+			t.Errorf("v%v: %v", version, err)
+			continue
+		}
+		if cmd, _ := conf.Commands.Get("a"); !cmd.Once {
+			t.Errorf("v%v: run_once isn't converted to once", version)
+		}
+	}
+}
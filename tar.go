@@ -3,7 +3,9 @@ package sup
 import (
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -16,10 +18,71 @@ import (
 // to properly receive the created TAR stream.
 // TODO: Check for relative directory.
 func RemoteTarCommand(dir string) string {
-	return fmt.Sprintf("tar -C \"%s\" -xzf -", dir)
+	return remoteTarCommand(dir, true)
+}
+
+func remoteTarCommand(dir string, compress bool) string {
+	return fmt.Sprintf("tar -C \"%s\" %s -", remotePath(dir), tarFlags("x", compress))
+}
+
+// remoteTarModeCommand returns command receiving the TAR stream like
+// remoteTarCommand, setting mode and owner of the extracted paths, if set.
+// The paths are extracted with umask 077, so they're never more permissive
+// than the mode. Directories get execute bits of the mode's read bits,
+// ie. 0750 for 0640. The paths are listed by "tar -t" of a copy of the
+// stream, as "tar -xv" lists them to STDERR on some systems, ie. bsdtar.
+func remoteTarModeCommand(dir string, compress bool, mode os.FileMode, owner string) string {
+	if mode == 0 && owner == "" {
+		return remoteTarCommand(dir, compress)
+	}
+
+	var set string
+	if mode != 0 {
+		dirMode := mode | (mode&0444)>>2
+		set = fmt.Sprintf(`if [ -d "$p" ]; then chmod %04o "$p"; else chmod %04o "$p"; fi || exit 1; `, dirMode, mode)
+	}
+	if owner != "" {
+		set += fmt.Sprintf(`chown -h %v "$p" || exit 1; `, owner)
+	}
+	extract := remoteTarCommand(dir, compress)
+	if mode != 0 {
+		extract = "(umask 077 && " + extract + ")"
+	}
+	return fmt.Sprintf(`t=$(mktemp) || exit 1; `+
+		`tee "$t" | %s && paths=$(tar %s "$t"); s=$?; rm -f "$t"; [ $s -eq 0 ] || exit $s; `+
+		`[ -n "$paths" ] || { echo "no paths extracted to %s to set mode or owner of" >&2; exit 1; }; `+
+		`echo "$paths" | while IFS= read -r f; do p="%s/$f"; %sdone`,
+		extract, tarFlags("t", compress), dir, remotePath(dir), set)
+}
+
+// tarFlags returns tar flags of the mode, ie. "x" or "c", gzipped if compress.
+func tarFlags(mode string, compress bool) string {
+	if compress {
+		return "-" + mode + "zf"
+	}
+	return "-" + mode + "f"
+}
+
+// RemoteTarCreateCommand returns command to be run on remote SSH host
+// to create TAR stream of a remote path.
+func RemoteTarCreateCommand(src string) string {
+	return fmt.Sprintf("tar -C \"%s\" -czf - \"%s\"", remotePath(path.Dir(src)), path.Base(src))
+}
+
+// remotePath replaces leading "~" of the remote path by $HOME, which is
+// expanded by the remote shell, unlike "~" in the double-quoted path.
+func remotePath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return "$HOME" + p[1:]
+	}
+	return p
 }
 
 func LocalTarCmdArgs(path, exclude string) []string {
+	return localTarArgs([]string{path}, exclude, true)
+}
+
+func localTarArgs(paths []string, exclude string, compress bool) []string {
 	args := []string{}
 
 	// Added pattens to exclude from tar compress
@@ -31,14 +94,18 @@ func LocalTarCmdArgs(path, exclude string) []string {
 		}
 	}
 
-	args = append(args, "-C", ".", "-czf", "-", path)
-	return args
+	args = append(args, "-C", ".", tarFlags("c", compress), "-")
+	return append(args, paths...)
 }
 
 // NewTarStreamReader creates a tar stream reader from a local path.
 // TODO: Refactor. Use "archive/tar" instead.
 func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
-	cmd := exec.Command("tar", LocalTarCmdArgs(path, exclude)...)
+	return newTarStreamReader(cwd, []string{path}, exclude, true)
+}
+
+func newTarStreamReader(cwd string, paths []string, exclude string, compress bool) (io.Reader, error) {
+	cmd := exec.Command("tar", localTarArgs(paths, exclude, compress)...)
 	cmd.Dir = cwd
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -51,3 +118,39 @@ func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
 
 	return stdout, nil
 }
+
+// NewTarStreamWriter creates a tar stream writer extracting
+// the stream to a local directory. Close waits for the extraction to finish.
+func NewTarStreamWriter(dir string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "tar: creating directory failed")
+	}
+
+	cmd := exec.Command("tar", "-C", dir, "-xzf", "-")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "tar: stdin pipe failed")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "tar: starting cmd failed")
+	}
+
+	return &tarStreamWriter{stdin, cmd}, nil
+}
+
+type tarStreamWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (w *tarStreamWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return errors.Wrap(err, "tar: closing stdin failed")
+	}
+	if err := w.cmd.Wait(); err != nil {
+		return errors.Wrap(err, "tar: extracting failed")
+	}
+	return nil
+}
@@ -1,10 +1,14 @@
 package sup
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,11 +17,38 @@ import (
 type Task struct {
 	Run     string
 	Input   io.Reader
+	Output  func(c Client) (io.WriteCloser, error) // Consumes the clients' STDOUT, if set.
+	Capture *bytes.Buffer                          // Captures the clients' STDOUT, if set.
 	Clients []Client
 	TTY     bool
+	Timeout time.Duration
+	Sudo    string // Sudo prefix the task is run with, ie. "sudo -u deploy --".
+	Silent  bool   // Print the clients' output only if the task fails on them?
+
+	check *changeCheck      // Changed check of the command the task is part of, if any.
+	skip  *skipCheck        // Set if the task is the command's skip_if guard.
+	runs  map[Client]string // Run rendered per client, if the command is templated.
+
+	uploaded *uploadRecord // Records the task's incremental upload, if it's one.
+
+	pool *uploadPool               // Pool running the task, if it's an upload to a single client of one.
+	open func() (io.Reader, error) // Opens the Input of the pool's upload, once it's started.
+
+	ignoreExit []int // Exit codes counting as success, see Command.IgnoreExit.
+
+	env string // Exports of the command's own env vars, after the client's ones.
+
+	forwardAgent bool // Forward the local SSH agent to the remote sessions?
+
+	shell      string // Remote shell wrapping the run, if set; see Command.Shell.
+	localShell string // Shell the LocalhostClient runs the task by, "bash" if empty.
+
+	Retry        int           // Number of retries on failed clients.
+	RetryDelay   time.Duration // Delay between the retries.
+	RetryBackoff bool          // Double the delay after each retry?
 }
 
-func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
+func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string, vars templateVars) ([]*Task, error) {
 	var tasks []*Task
 
 	cwd, err := os.Getwd()
@@ -25,40 +56,187 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		return nil, errors.Wrap(err, "resolving CWD failed")
 	}
 
+	timeout, err := cmd.timeout()
+	if err != nil {
+		return nil, errors.Wrap(err, cmd.Name)
+	}
+	retryDelay, err := cmd.retryDelay()
+	if err != nil {
+		return nil, errors.Wrap(err, cmd.Name)
+	}
+
+	// The command's own env vars override those of the clients.
+	cmdEnv := cmd.Env.AsExport()
+	vars = vars.withEnv(cmd.Env)
+
+	// Content fed to STDIN of the commands, if any.
+	var stdin []byte
+	switch {
+	case cmd.StdinFile != "":
+		stdin, err = ioutil.ReadFile(cmd.StdinFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read stdin_file")
+		}
+		if stdin == nil {
+			stdin = []byte{}
+		}
+	case cmd.StdinData != "":
+		stdin = []byte(cmd.StdinData)
+	}
+
+	// Change to the remote working directory first, if set.
+	chdir := ""
+	if cmd.Dir != "" {
+		chdir = `cd "` + remotePath(cmd.Dir) + `" || exit 1;` + "\n"
+	}
+
+	// Skip the command on the hosts its guard passes on.
+	if cmd.SkipIf != "" {
+		task := newSkipCheck().task(chdir + cmd.SkipIf)
+		task.Sudo = cmd.sudo(sup.sudoPass != "")
+		tasks = append(tasks, task.forClients(cmd, clients, sup.maxParallel)...)
+	}
+
+	// Check the hosts before the command, to report if it changed them.
+	var check *changeCheck
+	if cmd.Changed != "" {
+		check = newChangeCheck()
+		task := check.task(chdir+cmd.Changed, false)
+		task.Sudo = cmd.sudo(sup.sudoPass != "")
+		tasks = append(tasks, task.forClients(cmd, clients, sup.maxParallel)...)
+	}
+
 	// Anything to upload?
 	for _, upload := range cmd.Upload {
-		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
+		uploadPaths, err := upload.paths(cwd, env+cmdEnv)
 		if err != nil {
-			return nil, errors.Wrap(err, "upload: "+upload.Src)
+			return nil, errors.Wrap(err, "upload: "+upload.name())
+		}
+		if len(uploadPaths) == 0 {
+			continue // Nothing matched, allowed to be empty.
 		}
-		uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
+		mode, err := upload.mode()
 		if err != nil {
-			return nil, errors.Wrap(err, "upload: "+upload.Src)
+			return nil, errors.Wrap(err, "upload: "+upload.name())
 		}
 
 		task := Task{
-			Run:   RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
-			TTY:   false,
-		}
-
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
+			Run: remoteTarModeCommand(upload.Dst, upload.compress(), mode, upload.Owner),
+			TTY: false,
+		}
+
+		// Templated dsts are rendered per client.
+		dsts, err := upload.renderDsts(clients, vars)
+		if err != nil {
+			return nil, errors.Wrapf(err, "command %v", cmd.Name)
+		}
+		if dsts != nil {
+			task.runs = make(map[Client]string, len(dsts))
+			for c, dst := range dsts {
+				task.runs[c] = remoteTarModeCommand(dst, upload.compress(), mode, upload.Owner)
+			}
+		}
+
+		// Incremental uploads upload the files changed since the last
+		// upload to all the hosts of a batch, or all, if it's the first.
+		var state *uploadState
+		if upload.Incremental {
+			if state, err = sup.loadUploadState(cwd); err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.name())
+			}
+		}
+		start := time.Now()
+
+		// Every batch of the clients reads a tar stream of its own; uploads
+		// of a pool, one per client, open theirs once they're started.
+		batches := task.forClients(cmd, clients, sup.maxParallel)
+		pool := cmd.uploadPool(len(clients))
+		if pool != nil {
+			batches = task.forEachClient(clients)
+		}
+		name, exclude, compress := upload.name(), upload.Exc, upload.compress()
+		unchanged := 0
+		for _, batch := range batches {
+			paths := uploadPaths
+			open := func() (io.Reader, error) {
+				return newTarStreamReader(cwd, paths, exclude, compress)
+			}
+			if state != nil {
+				record := &uploadRecord{state: state, keys: make(map[Client]string), start: start}
+				var keys []string
+				for _, c := range batch.Clients {
+					hostUpload := upload
+					if dst, ok := dsts[c]; ok {
+						hostUpload.Dst = dst
+					}
+					key, err := uploadKey(hostUpload, vars(c))
+					if err != nil {
+						return nil, errors.Wrap(err, "upload: "+upload.Dst)
+					}
+					record.keys[c] = key
+					keys = append(keys, key)
+				}
+				if since := state.since(keys); !since.IsZero() {
+					if paths, err = changedFiles(cwd, uploadPaths, upload.Exc, since); err != nil {
+						return nil, errors.Wrap(err, "upload: "+upload.name())
+					}
+					if len(paths) == 0 {
+						if pool != nil {
+							unchanged++
+							continue
+						}
+						sup.log.Infof("%v: upload %v: no files changed since %v", cmd.Name, upload.name(), since.Format(time.RFC3339))
+						continue
+					}
 				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
+				batch.uploaded = record
+				open = func() (io.Reader, error) {
+					return newTarFilesReader(cwd, paths, exclude, compress)
+				}
+			}
+			if pool != nil {
+				batch.pool = pool
+				batch.open = func() (io.Reader, error) {
+					r, err := open()
+					if err != nil {
+						return nil, errors.Wrap(err, "upload: "+name)
+					}
+					return sup.interrupts.abortable(sup.limitUpload(r, pool.size)), nil
+				}
+				tasks = append(tasks, batch)
+				continue
+			}
+			uploadTarReader, err := open()
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.name())
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
+			batch.Input = sup.interrupts.abortable(sup.limitUpload(uploadTarReader, len(batch.Clients)))
+			tasks = append(tasks, batch)
+		}
+		if unchanged > 0 {
+			sup.log.Infof("%v: upload %v: no files changed on %v host(s) since their last upload", cmd.Name, name, unchanged)
+		}
+
+		// Compare the checksums of the uploaded files, if there are any.
+		if upload.Verify {
+			checksums, err := uploadChecksums(cwd, uploadPaths, upload.Exc)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.name())
+			}
+			if len(checksums) == 0 {
+				continue
+			}
+			verify := Task{
+				Run: remoteVerifyCommand(upload.Dst),
+				TTY: false,
+			}
+			if dsts != nil {
+				verify.runs = make(map[Client]string, len(dsts))
+				for c, dst := range dsts {
+					verify.runs[c] = remoteVerifyCommand(dst)
+				}
+			}
+			tasks = append(tasks, feed(verify.forClients(cmd, clients, sup.maxParallel), checksums)...)
 		}
 	}
 
@@ -73,91 +251,283 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 			return nil, errors.Wrap(err, "can't read script")
 		}
 
+		compose := func(script string) string {
+			if cmd.Args != "" {
+				// Set the script's positional parameters.
+				script = "set -- " + cmd.Args + ";\n" + script
+			}
+			script = chdir + script
+			if sup.debug {
+				script = "set -x;" + script
+			}
+			return script
+		}
 		task := Task{
-			Run: string(data),
-			TTY: true,
+			Run: compose(string(data)),
+			TTY: cmd.pty(),
 		}
-		if sup.debug {
-			task.Run = "set -x;" + task.Run
+		task.runs, err = cmd.renderRuns("script", string(data), clients, vars, compose)
+		if err != nil {
+			return nil, err
 		}
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
-			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
-		}
+		task.Sudo = cmd.sudo(sup.sudoPass != "")
+		task.ignoreExit = cmd.IgnoreExit
+		task.shell = cmd.Shell
+		tasks = append(tasks, feed(task.forClients(cmd, clients, sup.maxParallel), stdin)...)
 	}
 
-	// Local command.
+	// Local command, once or once per host with the host's env vars.
 	if cmd.Local != "" {
-		local := &LocalhostClient{
+		locals := []Client{&LocalhostClient{
 			env: env + `export SUP_HOST="localhost";`,
+		}}
+		if cmd.LocalPerHost {
+			locals = make([]Client, len(clients))
+			for i, c := range clients {
+				locals[i] = &LocalhostClient{env: clientEnv(c), target: c}
+			}
+		}
+		for _, local := range locals {
+			local.Connect("localhost")
+		}
+		compose := func(local string) string {
+			if sup.debug {
+				return "set -x;" + local
+			}
+			return local
 		}
-		local.Connect("localhost")
 		task := &Task{
-			Run:     cmd.Local,
-			Clients: []Client{local},
-			TTY:     true,
+			Run:        compose(cmd.Local),
+			Clients:    locals,
+			TTY:        true,
+			ignoreExit: cmd.IgnoreExit,
+			localShell: cmd.LocalShell,
 		}
-		if sup.debug {
-			task.Run = "set -x;" + task.Run
+		task.runs, err = cmd.renderRuns("local", cmd.Local, locals, vars, compose)
+		if err != nil {
+			return nil, err
 		}
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		tasks = append(tasks, task)
+		if cmd.CaptureEnv != "" {
+			task.Capture = &bytes.Buffer{}
+		}
+		tasks = append(tasks, feed([]*Task{task}, stdin)...)
 	}
 
 	// Remote command.
 	if cmd.Run != "" {
+		compose := func(run string) string {
+			if sup.debug {
+				return "set -x;" + chdir + run
+			}
+			return chdir + run
+		}
 		task := Task{
-			Run: cmd.Run,
-			TTY: true,
+			Run: compose(cmd.Run),
+			TTY: cmd.pty(),
 		}
-		if sup.debug {
-			task.Run = "set -x;" + task.Run
+		task.runs, err = cmd.renderRuns("run", cmd.Run, clients, vars, compose)
+		if err != nil {
+			return nil, err
 		}
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
+		task.Sudo = cmd.sudo(sup.sudoPass != "")
+		task.ignoreExit = cmd.IgnoreExit
+		task.shell = cmd.Shell
+		tasks = append(tasks, feed(task.forClients(cmd, clients, sup.maxParallel), stdin)...)
+	}
+
+	// Anything to download?
+	for _, download := range cmd.Download {
+		download := download
+		dst, err := template.New("dst").Parse(download.Dst)
+		if err != nil {
+			return nil, errors.Wrap(err, "download: "+download.Dst)
+		}
+
+		task := Task{
+			Run: RemoteTarCreateCommand(download.Src),
+			Output: func(c Client) (io.WriteCloser, error) {
+				var buf bytes.Buffer
+				if err := dst.Execute(&buf, struct{ Host string }{c.Host()}); err != nil {
+					return nil, errors.Wrap(err, "download: "+download.Dst)
 				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
-			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
+				dir, err := ResolveLocalPath(cwd, buf.String(), env+cmdEnv)
+				if err != nil {
+					return nil, errors.Wrap(err, "download: "+download.Dst)
+				}
+				return NewTarStreamWriter(dir)
+			},
+			TTY: false,
 		}
+
+		tasks = append(tasks, task.forClients(cmd, clients, sup.maxParallel)...)
+	}
+
+	// Check the hosts again after the command.
+	if check != nil {
+		task := check.task(chdir+cmd.Changed, true)
+		task.Sudo = cmd.sudo(sup.sudoPass != "")
+		tasks = append(tasks, task.forClients(cmd, clients, sup.maxParallel)...)
+	}
+
+	for _, task := range tasks {
+		task.Silent = cmd.Silent
+		task.Timeout = timeout
+		task.Retry = cmd.Retry
+		task.RetryDelay = retryDelay
+		task.RetryBackoff = cmd.RetryBackoff
+		task.env = cmdEnv
+		task.forwardAgent = cmd.forwardsAgent()
 	}
 
 	return tasks, nil
 }
 
+// pty reports whether the command's remote sessions request a pseudo-terminal,
+// which is the default.
+func (cmd *Command) pty() bool {
+	return cmd.Pty == nil || *cmd.Pty
+}
+
+// forwardsAgent reports whether the command's remote sessions forward the
+// local SSH agent.
+func (cmd *Command) forwardsAgent() bool {
+	return cmd.ForwardAgent != nil && *cmd.ForwardAgent
+}
+
+// sudo returns the sudo prefix the command should be run with, if any.
+// With password, sudo reads the password from STDIN without a prompt,
+// ignoring cached credentials, so it always consumes the password.
+func (cmd *Command) sudo(password bool) string {
+	if cmd.User == "" && !cmd.Sudo {
+		return ""
+	}
+	sudo := "sudo"
+	if password {
+		sudo += " -k -S -p ''"
+	}
+	if cmd.SudoHome {
+		sudo += " -H"
+	}
+	if cmd.User != "" {
+		sudo += " -u " + shellQuote(cmd.User)
+	}
+	return sudo + " --"
+}
+
+// command returns the shell command the client runs for the task, run by
+// the task's shell, if set. Sudo resets the environment, so the env is
+// exported within the sudo'ed shell, bash unless the task's shell is set.
+func (task *Task) command(c Client, env string) string {
+	env += task.env
+	run := task.Run
+	if r, ok := task.runs[c]; ok {
+		run = r
+	}
+	shell := task.shell
+	if task.Sudo == "" {
+		if shell == "" {
+			return env + run
+		}
+		return shell + " -c " + shellQuote(env+run)
+	}
+	if shell == "" {
+		shell = "bash"
+	}
+	return task.Sudo + " " + shell + " -c " + shellQuote(env+run)
+}
+
+// guarded returns err of the task on the client, recorded by the skip_if
+// guard if the task is one, see skipCheck.record.
+func (task *Task) guarded(c Client, err error) error {
+	if task.skip == nil {
+		return err
+	}
+	return task.skip.record(c, err)
+}
+
+// ignores reports whether the task's command exited with a code counting
+// as success.
+func (task *Task) ignores(err error) bool {
+	code := exitCode(err)
+	for _, ignored := range task.ignoreExit {
+		if code == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// shellQuote quotes s for use as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// clientEnv returns the env vars the client's commands are run with.
+func clientEnv(c Client) string {
+	switch c := c.(type) {
+	case *SSHClient:
+		return c.env
+	case *LocalhostClient:
+		return c.env
+	}
+	return ""
+}
+
+// feed sets input of every task to the data, if not nil.
+func feed(tasks []*Task, data []byte) []*Task {
+	if data != nil {
+		for _, task := range tasks {
+			task.Input = bytes.NewReader(data)
+		}
+	}
+	return tasks
+}
+
+// forClients assigns the task to the clients the command should be run on.
+// Serial commands, and commands run on more than max clients, are split
+// to multiple tasks, each run on a batch of clients, executed sequentially.
+func (task Task) forClients(cmd *Command, clients []Client, max int) []*Task {
+	if cmd.Once {
+		task.Clients = []Client{clients[0]}
+		return []*Task{&task}
+	}
+
+	if batch := cmd.batch(max); batch > 0 && batch < len(clients) {
+		var tasks []*Task
+		for i := 0; i < len(clients); i += batch {
+			j := i + batch
+			if j > len(clients) {
+				j = len(clients)
+			}
+			copy := task
+			copy.Clients = clients[i:j]
+			tasks = append(tasks, &copy)
+		}
+		return tasks
+	}
+
+	task.Clients = clients
+	return []*Task{&task}
+}
+
+// batch returns the max number of clients the command is run on at once,
+// its serial capped by max, or 0 if it's unlimited.
+func (cmd *Command) batch(max int) int {
+	if max > 0 && (cmd.Serial == 0 || cmd.Serial > max) {
+		return max
+	}
+	return cmd.Serial
+}
+
 type ErrTask struct {
 	Task   *Task
 	Reason string
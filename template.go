@@ -0,0 +1,110 @@
+package sup
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// templateData is the context templated commands are rendered with,
+// ie. "{{.Env.VERSION}}" or "{{range .Network.Hosts}}".
+type templateData struct {
+	Env     map[string]string // Env vars of the host.
+	Host    string            // Host as listed by the network, or "localhost".
+	Network *Network
+}
+
+// templateVars returns the template data of the clients' hosts.
+type templateVars func(c Client) templateData
+
+// newTemplateVars returns the template data of the clients' hosts, with
+// the env vars of the run, current at the time of rendering, and those
+// of the hosts.
+func newTemplateVars(network *Network, env *EnvList, clientHosts map[Client]string) templateVars {
+	return func(c Client) templateData {
+		if local, ok := c.(*LocalhostClient); ok && local.target != nil {
+			c = local.target
+		}
+		vars := make(map[string]string, len(*env))
+		for _, v := range *env {
+			vars[v.Key] = v.Value
+		}
+
+		host := "localhost" // Local commands run once aren't run for any host.
+		if h, ok := clientHosts[c]; ok {
+			host = h
+			for _, v := range network.HostEnv[host] {
+				vars[v.Key] = v.Value
+			}
+		}
+		vars["SUP_HOST"] = host
+		return templateData{Env: vars, Host: host, Network: network}
+	}
+}
+
+// withEnv returns the template data of the clients' hosts, with the env
+// vars overriding theirs, ie. the command's.
+func (vars templateVars) withEnv(env EnvList) templateVars {
+	if len(env) == 0 {
+		return vars
+	}
+	return func(c Client) templateData {
+		data := vars(c)
+		for _, v := range env {
+			data.Env[v.Key] = v.Value
+		}
+		return data
+	}
+}
+
+// parseTemplate parses the body of a templated command's field, ie. "run".
+// Undefined env vars are errors, rather than rendered as "<no value>".
+func parseTemplate(field, body string) (*template.Template, error) {
+	return template.New(field).Option("missingkey=error").Parse(body)
+}
+
+// renderDsts renders the upload's dst per client, if it's templated, see
+// Upload.templated; plain dsts render to nil.
+func (u Upload) renderDsts(clients []Client, vars templateVars) (map[Client]string, error) {
+	if !u.templated() {
+		return nil, nil
+	}
+	tmpl, err := parseTemplate("dst", u.Dst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "upload %v", u.name())
+	}
+	dsts := make(map[Client]string, len(clients))
+	for _, c := range clients {
+		data := vars(c)
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, errors.Wrapf(err, "upload %v on %v", u.name(), data.Host)
+		}
+		dsts[c] = buf.String()
+	}
+	return dsts, nil
+}
+
+// renderRuns renders the body of the command's field per client, if the
+// command is templated, returning the commands run by the clients, composed
+// of the rendered bodies.
+func (cmd *Command) renderRuns(field, body string, clients []Client, vars templateVars, compose func(string) string) (map[Client]string, error) {
+	if !cmd.Template {
+		return nil, nil
+	}
+	tmpl, err := parseTemplate(field, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "command %v", cmd.Name)
+	}
+	runs := make(map[Client]string, len(clients))
+	for _, c := range clients {
+		data := vars(c)
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, errors.Wrapf(err, "command %v on %v", cmd.Name, data.Host)
+		}
+		runs[c] = compose(buf.String())
+	}
+	return runs, nil
+}
@@ -0,0 +1,114 @@
+package sup
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// uploadPool uploads to the hosts of a command, by a task per host each
+// reading a tar stream of its own, on up to size hosts at once, see
+// Command.MaxUploadParallel.
+type uploadPool struct {
+	size     int
+	failFast bool // Stop starting uploads once one failed?
+}
+
+// uploadPool returns the pool of the command's uploads to the hosts, or nil
+// if the uploads are batched as the command's other tasks.
+func (cmd *Command) uploadPool(hosts int) *uploadPool {
+	if cmd.MaxUploadParallel <= 0 || cmd.Once {
+		return nil
+	}
+	size := cmd.MaxUploadParallel
+	if size > hosts {
+		size = hosts
+	}
+	return &uploadPool{size: size, failFast: cmd.UploadFailFast}
+}
+
+// forEachClient assigns a copy of the task to each of the clients.
+func (task Task) forEachClient(clients []Client) []*Task {
+	tasks := make([]*Task, len(clients))
+	for i, c := range clients {
+		copy := task
+		copy.Clients = []Client{c}
+		tasks[i] = &copy
+	}
+	return tasks
+}
+
+// runPool runs the tasks of the pool, up to its size at once. The input of
+// a task is opened once it's started, so there are no more tar streams than
+// uploads in flight. Failures on the hosts are collected and returned once
+// all the uploads finished. No more uploads are started once the run's
+// interrupted, or once one failed if the pool fails fast.
+func (sup *Stackup) runPool(pool *uploadPool, tasks []*Task, maxLen int) error {
+	var failed ErrTaskFailed
+	var mu sync.Mutex
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pool.failFast && len(failed.Hosts) > 0
+	}
+
+	queue := make(chan *Task)
+	var wg sync.WaitGroup
+	for i := 0; i < pool.size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				err := sup.runUpload(task, maxLen)
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				failed.Hosts = append(failed.Hosts, err.Hosts...)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, task := range tasks {
+		if stopped() || sup.interrupts.interrupted() {
+			break
+		}
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+
+	if sup.interrupts.interrupted() {
+		return ErrInterrupted
+	}
+	if len(failed.Hosts) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// runUpload opens the input of the task of a single client and runs it,
+// returning any error as a failure of the client.
+func (sup *Stackup) runUpload(task *Task, maxLen int) *ErrTaskFailed {
+	c := task.Clients[0]
+	prefix := sup.prefixOf(c, maxLen)
+	if task.open != nil {
+		input, err := task.open()
+		if err != nil {
+			if sup.results != nil {
+				sup.results.of(c)
+				sup.results.done(c, err)
+			}
+			return &ErrTaskFailed{[]ErrHost{{prefix, err, c}}}
+		}
+		task.Input = input
+	}
+	switch err := sup.runTask(task, maxLen).(type) {
+	case nil:
+		return nil
+	case ErrTaskFailed:
+		return &err
+	default:
+		return &ErrTaskFailed{[]ErrHost{{prefix, errors.Cause(err), c}}}
+	}
+}
@@ -0,0 +1,98 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// uploadChecksums returns the sha256sum-formatted checksums of the regular
+// files of the upload's paths, relative to cwd, as they're extracted on the
+// hosts. Paths matching the comma-separated exclude patterns are skipped,
+// as tar skips them.
+func uploadChecksums(cwd string, paths []string, exclude string) ([]byte, error) {
+	var excludes []string
+	for _, pattern := range strings.Split(exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			excludes = append(excludes, pattern)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, path := range paths {
+		root := path
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(cwd, root)
+		}
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(path, strings.TrimPrefix(file, root)))
+			if excluded(name, excludes) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			sum, err := fileChecksum(file)
+			if err != nil {
+				return err
+			}
+			// Tar strips the leading "/" of absolute paths.
+			fmt.Fprintf(&buf, "%x  %v\n", sum, strings.TrimLeft(name, "/"))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "computing checksums failed")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// excluded reports whether the path, or any of its trailing components,
+// matches any of the exclude patterns.
+func excluded(path string, excludes []string) bool {
+	parts := strings.Split(path, "/")
+	for i := range parts {
+		suffix := strings.Join(parts[i:], "/")
+		for _, pattern := range excludes {
+			if ok, _ := filepath.Match(pattern, suffix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileChecksum returns the sha256 checksum of the file.
+func fileChecksum(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// remoteVerifyCommand returns command verifying the uploaded files in dir
+// match the checksums read from STDIN, by sha256sum or shasum, whichever
+// the host has.
+func remoteVerifyCommand(dir string) string {
+	return fmt.Sprintf(`cd "%s" || exit 1; `+
+		`if command -v sha256sum >/dev/null 2>&1; then sha256sum -c --quiet -; else shasum -a 256 -c -s -; fi `+
+		`|| { echo "checksums of the files uploaded to %s don't match" >&2; exit 1; }`, remotePath(dir), dir)
+}